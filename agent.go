@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	agentMinBackoff = time.Second
+	agentMaxBackoff = 5 * time.Minute
+	agentTimeout    = 30 * time.Second // of one upload
+	agentPending    = 10               // batches kept in memory while the queue fails, the oldest readings are dropped beyond
+)
+
+// errBatchRejected is returned for a batch the server will never take, it is dropped.
+var errBatchRejected = errors.New("batch rejected")
+
+// agent forwards the readings of the local collectors to the ingest API of a
+// central server. The readings are collected into batches, compressed and
+// queued on disk first, a batch only leaves the queue once the server
+// accepted it.
+type agent struct {
+	ingestURL string
+	batchSize int
+	flush     time.Duration
+	queue     *diskQueue
+	client    *http.Client
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	lock    sync.Mutex
+	pending []reading
+	full    chan struct{}
+}
+
+func newAgent(cfg *config) (*agent, error) {
+	if cfg.Agent.Server == "" {
+		return nil, errors.New("no server to forward to, see -server")
+	}
+
+	queue, err := openDiskQueue(cfg.Agent.Queue, cfg.Agent.MaxQueue)
+	if err != nil {
+		return nil, fmt.Errorf("opening the queue: %s", err)
+	}
+
+	var ag = &agent{
+		ingestURL:  strings.TrimSuffix(cfg.Agent.Server, "/") + "/api/ingest",
+		batchSize:  cfg.Agent.Batch,
+		flush:      time.Duration(cfg.Agent.Flush) * time.Millisecond,
+		queue:      queue,
+		client:     &http.Client{Timeout: agentTimeout},
+		minBackoff: agentMinBackoff,
+		maxBackoff: agentMaxBackoff,
+		full:       make(chan struct{}, 1),
+	}
+	if ag.batchSize <= 0 {
+		ag.batchSize = 500
+	}
+	if ag.flush <= 0 {
+		ag.flush = 5 * time.Second
+	}
+	return ag, nil
+}
+
+// Observe is registered as observer of the local broker.
+func (ag *agent) Observe(r reading) {
+	ag.lock.Lock()
+	ag.pending = append(ag.pending, r)
+	var full = len(ag.pending) >= ag.batchSize
+	ag.lock.Unlock()
+
+	if full {
+		select {
+		case ag.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run batches and uploads until the context is cancelled.
+func (ag *agent) Run(ctx context.Context) {
+	go ag.forward(ctx)
+
+	var ticker = time.NewTicker(ag.flush)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-ag.full:
+		}
+
+		if err := ag.Flush(); err != nil {
+			log.Println("Queueing readings:", err)
+		}
+	}
+}
+
+// Flush queues the pending readings as a batch. Readings that could not be
+// queued stay pending for the next flush.
+func (ag *agent) Flush() error {
+	ag.lock.Lock()
+	var rs = ag.pending
+	ag.pending = nil
+	ag.lock.Unlock()
+
+	if len(rs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	var zw = gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(rs); err != nil {
+		ag.requeue(rs)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		ag.requeue(rs)
+		return err
+	}
+
+	if err := ag.queue.Push(buf.Bytes()); err != nil {
+		ag.requeue(rs)
+		return err
+	}
+	return nil
+}
+
+// requeue puts readings back in front of the pending ones, up to
+// agentPending batches.
+func (ag *agent) requeue(rs []reading) {
+	ag.lock.Lock()
+	defer ag.lock.Unlock()
+
+	var all = append(rs, ag.pending...)
+	if max := agentPending * ag.batchSize; len(all) > max {
+		log.Println("Queue failing, dropping", len(all)-max, "readings")
+		all = all[len(all)-max:]
+	}
+	ag.pending = all
+}
+
+// forward uploads the queued batches oldest first, retrying with a backoff.
+func (ag *agent) forward(ctx context.Context) {
+	var bo = newBackoff(ag.minBackoff, ag.maxBackoff)
+	for {
+		name, batch, err := ag.queue.Peek()
+		if err != nil {
+			log.Println("Reading the queue:", err)
+		}
+
+		if err != nil || name == "" {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ag.queue.Pushed():
+			case <-time.After(ag.flush):
+			}
+			continue
+		}
+
+		err = ag.upload(ctx, batch)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == errBatchRejected {
+			log.Println("Server rejected", name, "dropping it")
+		} else if err != nil {
+			log.Printf("Uploading %s: %s, %d batches queued, retrying in %s\n", name, err, ag.queue.Len(), bo.Next())
+			if !bo.Wait(ctx) {
+				return
+			}
+			continue
+		}
+
+		bo.Reset()
+		if err = ag.queue.Remove(name); err != nil {
+			log.Println("Removing", name, "from the queue:", err)
+		}
+	}
+}
+
+// upload posts one gzipped batch to the ingest API.
+func (ag *agent) upload(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, ag.ingestURL, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := ag.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		return errBatchRejected
+	default:
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+}
+
+// decodeIngest reads a batch of readings as posted to the ingest API, the
+// body is a JSON array, gzipped if the encoding says so.
+func decodeIngest(body io.Reader, encoding string) ([]reading, error) {
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	var rs []reading
+	if err := json.NewDecoder(body).Decode(&rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// agentHandler serves the metrics and the health checks of the agent, the
+// agent serves no readings.
+func agentHandler(health *healthChecks) http.Handler {
+	var check = func(ok func([]componentHealth) bool, failing string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var cs = health.Components()
+			var status, code = "ok", http.StatusOK
+			if !ok(cs) {
+				status, code = failing, http.StatusServiceUnavailable
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "components": cs})
+		}
+	}
+
+	var mux = http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", check(health.Healthy, "failing"))
+	mux.Handle("/readyz", check(health.Ready, "not ready"))
+	return mux
+}
+
+// serveAgent serves the handler of the agent until the context is cancelled.
+func serveAgent(ctx context.Context, listen string, health *healthChecks) {
+	var srv = &http.Server{Addr: listen, Handler: agentHandler(health)}
+	var failed = make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	var shutdownCtx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Stopping the metrics server:", err)
+	}
+}
+
+// runAgent is the agent subcommand: it runs the collectors like the server
+// does, but forwards the readings instead of serving them.
+func runAgent(args []string) {
+	cfg, err := parseConfig(flag.NewFlagSet("agent", flag.ExitOnError), args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ag, err := newAgent(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var sv = newSupervisor()
+	var broker = NewSSEBroker()
+	var devices = newDeviceRegistry()
+	broker.AddObserver(ag.Observe)
+
+	var health = newHealthChecks()
+	var started = time.Now()
+	health.Add(healthFunc(func() []componentHealth {
+		return []componentHealth{{Kind: "web", Name: cfg.Listen, Status: componentUp, Since: started, Critical: true}}
+	}))
+	runCollectors(sv, cfg, broker, devices, health)
+
+	log.Println("Forwarding to", ag.ingestURL)
+	sv.Go("agent", ag.Run)
+	sv.Go("metrics", func(ctx context.Context) {
+		serveAgent(ctx, cfg.Listen, health)
+	})
+
+	// the last readings of the collectors wait in the queue for the next start
+	sv.OnShutdown("agent queue", func(ctx context.Context) error {
+		return ag.Flush()
+	})
+
+	sv.Wait()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openDiskQueue(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{"a", "b", "c"} {
+		if err = q.Push([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest batch was dropped, the others survive a restart
+	if q, err = openDiskQueue(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len(); n != 2 {
+		t.Errorf("%d batches queued, want 2", n)
+	}
+
+	for _, want := range []string{"b", "c"} {
+		name, b, err := q.Peek()
+		if err != nil || string(b) != want {
+			t.Fatalf("got %q, %v, want %q", b, err, want)
+		}
+		q.Remove(name)
+	}
+	if name, _, _ := q.Peek(); name != "" {
+		t.Errorf("got %s from an empty queue", name)
+	}
+}
+
+func TestAgentKeepsReadingsWhenQueueFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cfg = defaultConfig()
+	cfg.Agent.Server = "http://localhost"
+	cfg.Agent.Queue = filepath.Join(dir, "queue")
+	cfg.Agent.Batch = 2
+	ag, err := newAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the disk is gone
+	os.RemoveAll(cfg.Agent.Queue)
+	for i := 0; i < 3; i++ {
+		ag.Observe(reading{Hostname: "edge", SensorID: 1, Reading: float64(i)})
+	}
+	if err = ag.Flush(); err == nil {
+		t.Fatal("flushed into a missing queue")
+	}
+	// kept up to agentPending batches
+	for i := 3; i < 3+agentPending*2; i++ {
+		ag.Observe(reading{Hostname: "edge", SensorID: 1, Reading: float64(i)})
+	}
+	ag.Flush()
+
+	os.Mkdir(cfg.Agent.Queue, 0700)
+	if err = ag.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_, batch, err := ag.queue.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := decodeIngest(bytes.NewReader(batch), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != agentPending*2 || rs[0].Reading != 3.0 || rs[len(rs)-1].Reading != float64(2+agentPending*2) {
+		t.Errorf("queued %d readings from %v to %v", len(rs), rs[0].Reading, rs[len(rs)-1].Reading)
+	}
+}
+
+// ingestServer fails the first uploads and then records the readings.
+type ingestServer struct {
+	lock     sync.Mutex
+	failures int
+	readings []reading
+}
+
+func (is *ingestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+
+	if is.failures > 0 {
+		is.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	rs, err := decodeIngest(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	is.readings = append(is.readings, rs...)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (is *ingestServer) received() int {
+	is.lock.Lock()
+	defer is.lock.Unlock()
+	return len(is.readings)
+}
+
+func TestAgentForwardsAfterFailures(t *testing.T) {
+	var is = &ingestServer{failures: 2}
+	var srv = httptest.NewServer(is)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cfg = defaultConfig()
+	cfg.Agent.Server = srv.URL
+	cfg.Agent.Queue = dir
+	cfg.Agent.Batch = 2
+	cfg.Agent.Flush = 10
+
+	ag, err := newAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag.minBackoff = 10 * time.Millisecond
+
+	var broker = NewSSEBroker()
+	broker.AddObserver(ag.Observe)
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go ag.Run(ctx)
+
+	for i := 0; i < 5; i++ {
+		broker.NewReading(reading{Hostname: "edge", SensorID: 1, Quantity: "temperature", Reading: float64(i)})
+	}
+
+	// the batch is removed after the server replied
+	var timeout = time.After(2 * time.Second)
+	for is.received() < 5 || ag.queue.Len() != 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("server received %d readings, want 5, %d batches left in the queue", is.received(), ag.queue.Len())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if is.readings[0].Hostname != "edge" || is.readings[0].Reading != 0.0 {
+		t.Errorf("unexpected reading %+v", is.readings[0])
+	}
+}
+
+func TestAgentHandler(t *testing.T) {
+	var queue = newComponentState()
+	var health = newHealthChecks()
+	health.Add(healthFunc(func() []componentHealth {
+		var h = queue.health("storage", "queue")
+		h.Critical = true
+		return []componentHealth{h}
+	}))
+	storageWrites.WithLabelValues("queue").Observe(0.001)
+
+	var srv = httptest.NewServer(agentHandler(health))
+	defer srv.Close()
+
+	var get = func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("/metrics"); code != http.StatusOK || !strings.Contains(body, `predictive_storage_write_seconds_count{storage="queue"}`) {
+		t.Errorf("metrics answered %d %q", code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("liveness answered %d", code)
+	}
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness answered %d without the queue", code)
+	}
+	queue.Up()
+	if code, body := get("/readyz"); code != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+		t.Errorf("readiness answered %d %q", code, body)
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/ohheydom/linearregression"
 )
 
@@ -78,3 +85,147 @@ func calculateLR(sensorID string, rawValues []float64, windowSize int) (int, flo
 
 	return 0, 0
 }
+
+// predictWindow is the window of the moving average, a history longer by
+// one gives the same prediction as the full history.
+const predictWindow = 30
+
+// predict fills the moving average and the targets of a reading from the
+// values of its stream, as the dashboard shows them.
+func predict(r *reading, history []float64) {
+	// derived readings, e.g. vibration features, bring their own band
+	if r.MinAlarm == 0 && r.MaxAlarm == 0 {
+		r.MinAlarm = 800
+		r.MaxAlarm = 1500
+	}
+
+	ma := calculateMA("", history, predictWindow)
+	// _, lr := calculateLR("", history, predictWindow)
+
+	formatted, _ := strconv.ParseFloat(fmt.Sprintf("%.2f", ma), 64)
+	r.CE = formatted
+	r.TE = 1000
+	r.MRE = 900
+	// r.TUF = lr
+}
+
+// checkAlarm flags a reading whose value is outside of its alarm band.
+// A limit of 0 is not set, readings without a numeric value are left alone.
+func checkAlarm(r *reading) {
+	var v, ok = r.Reading.(float64)
+	if !ok || r.Maintenance || (r.MinAlarm == 0 && r.MaxAlarm == 0) {
+		return
+	}
+
+	if (r.MinAlarm != 0 && v < r.MinAlarm) || (r.MaxAlarm != 0 && v > r.MaxAlarm) {
+		r.Alarm = "true"
+	}
+}
+
+// activeAlarm is a stream outside of its alarm band.
+type activeAlarm struct {
+	Reading  reading   `json:"reading"` // that raised the alarm
+	RaisedAt time.Time `json:"raised_at"`
+	AckedBy  string    `json:"acked_by,omitempty"`
+	AckedAt  time.Time `json:"acked_at"`
+}
+
+// errNoAlarm is returned for the acknowledgement of a stream without alarm.
+var errNoAlarm = errors.New("no active alarm")
+
+// alarmTracker turns the alarm flag of the readings into transitions. It
+// publishes an "alarm" event when a stream leaves its alarm band and an
+// "alarm_cleared" event when it is back inside. An acknowledged alarm is
+// published as "alarm_acknowledged" event, with who acknowledged it as data.
+// The readings taken in maintenance change nothing.
+type alarmTracker struct {
+	sseBroker *SSEBroker
+	active    map[string]bool         // by stream
+	alarms    map[string]*activeAlarm // the raised ones of active, by stream
+	locker    sync.Mutex
+}
+
+func newAlarmTracker(sseBroker *SSEBroker) *alarmTracker {
+	return &alarmTracker{
+		sseBroker: sseBroker,
+		active:    make(map[string]bool),
+		alarms:    make(map[string]*activeAlarm),
+	}
+}
+
+// Observe is registered as observer of the broker.
+func (at *alarmTracker) Observe(r reading) {
+	if r.Event != "" || r.Maintenance || (r.MinAlarm == 0 && r.MaxAlarm == 0) {
+		return
+	}
+
+	var raised = r.Alarm == "true"
+	var stream = r.stream()
+
+	at.locker.Lock()
+	if at.active[stream] == raised {
+		at.locker.Unlock()
+		return
+	}
+	at.active[stream] = raised
+	if raised {
+		at.alarms[stream] = &activeAlarm{Reading: r, RaisedAt: time.Now()}
+	} else {
+		delete(at.alarms, stream)
+	}
+	at.locker.Unlock()
+
+	r.Event = "alarm_cleared"
+	if raised {
+		r.Event = "alarm"
+		alarmsRaised.WithLabelValues(r.Hostname, strconv.FormatUint(uint64(r.SensorID), 10), r.Quantity).Inc()
+	}
+	at.sseBroker.NewReading(r)
+}
+
+// Acknowledge records that someone took care of the alarm of a stream.
+func (at *alarmTracker) Acknowledge(stream, by string) error {
+	at.locker.Lock()
+	var a, ok = at.alarms[stream]
+	if !ok {
+		at.locker.Unlock()
+		return errNoAlarm
+	}
+	a.AckedBy = by
+	a.AckedAt = time.Now()
+	var r = a.Reading
+	at.locker.Unlock()
+
+	r.Event = "alarm_acknowledged"
+	r.Data = by
+	r.PublishedAt = a.AckedAt
+	at.sseBroker.NewReading(r)
+	return nil
+}
+
+// Alarms returns the active alarms, oldest first.
+func (at *alarmTracker) Alarms() []activeAlarm {
+	at.locker.Lock()
+	defer at.locker.Unlock()
+
+	var as = make([]activeAlarm, 0, len(at.alarms))
+	for _, a := range at.alarms {
+		as = append(as, *a)
+	}
+	sort.Slice(as, func(i, j int) bool { return as[i].RaisedAt.Before(as[j].RaisedAt) })
+	return as
+}
+
+// Active returns the number of streams in alarm.
+func (at *alarmTracker) Active() int {
+	at.locker.Lock()
+	defer at.locker.Unlock()
+
+	var n = 0
+	for _, raised := range at.active {
+		if raised {
+			n++
+		}
+	}
+	return n
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"testing"
+	"time"
 )
 
 var rawValues = []float64{
@@ -24,3 +26,69 @@ func TestCalculateLR(t *testing.T) {
 	log.Println(dayTriggered, triggeredVal)
 	t.Fail()
 }
+
+func TestAlarmTrackerTransitions(t *testing.T) {
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte, 100)
+	broker.AddClient(ch)
+	broker.AddObserver(newAlarmTracker(broker).Observe)
+
+	for _, v := range []float64{10, 30, 35, 10, 12} {
+		broker.NewReading(reading{SensorID: 1, Quantity: "temperature", Reading: v, MaxAlarm: 25})
+	}
+
+	var events []string
+	var timeout = time.After(time.Second)
+	for len(events) < 2 {
+		select {
+		case <-timeout:
+			t.Fatalf("got events %v", events)
+		case b := <-ch:
+			var r reading
+			json.Unmarshal(b, &r)
+			if r.Event != "" {
+				events = append(events, r.Event)
+			}
+		}
+	}
+
+	// the fan out does not keep the order
+	if !(events[0] == "alarm" && events[1] == "alarm_cleared" || events[0] == "alarm_cleared" && events[1] == "alarm") {
+		t.Errorf("got events %v", events)
+	}
+}
+
+func TestAlarmTrackerAcknowledge(t *testing.T) {
+	var broker = NewSSEBroker()
+	var alarms = newAlarmTracker(broker)
+	broker.AddObserver(alarms.Observe)
+	var acks []reading
+	broker.AddObserver(func(r reading) {
+		if r.Event == "alarm_acknowledged" {
+			acks = append(acks, r)
+		}
+	})
+
+	var r = reading{Hostname: "edge1", SensorID: 1, Quantity: "temperature", Reading: 30.0, MaxAlarm: 25}
+	if err := alarms.Acknowledge(r.stream(), "anna"); err != errNoAlarm {
+		t.Errorf("acknowledged a stream without alarm: %v", err)
+	}
+
+	broker.NewReading(r)
+	if err := alarms.Acknowledge(r.stream(), "anna"); err != nil {
+		t.Fatal(err)
+	}
+	if len(acks) != 1 || acks[0].Data != "anna" || acks[0].stream() != r.stream() {
+		t.Errorf("got acknowledgements %v", acks)
+	}
+	var as = alarms.Alarms()
+	if len(as) != 1 || as[0].AckedBy != "anna" || as[0].AckedAt.IsZero() {
+		t.Errorf("got alarms %v", as)
+	}
+
+	r.Reading = 10.0
+	broker.NewReading(r)
+	if as = alarms.Alarms(); len(as) != 0 {
+		t.Errorf("cleared alarm still active: %v", as)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The annotations the API rejects.
+var (
+	errAnnotationText  = errors.New("annotation needs a text")
+	errAnnotationRange = errors.New("annotation ends before it starts")
+)
+
+// annotation labels a time range, or a point in time, e.g. "bearing
+// replaced" or "oil changed". It concerns a stream, an asset or, without
+// either, all of them.
+type annotation struct {
+	ID     int       `json:"id"`
+	Asset  string    `json:"asset"`
+	Stream string    `json:"stream"` // hostname/sensorID/quantity
+	Start  time.Time `json:"start"`  // now if zero
+	End    time.Time `json:"end"`    // the same as Start for a point in time
+	Text   string    `json:"text"`
+	By     string    `json:"by"`
+	Source string    `json:"source"` // api, or alarm for the acknowledgements
+}
+
+// matches reports whether the annotation concerns the asset or the stream.
+// An annotation without either concerns all, an empty asset and stream
+// match all annotations.
+func (a annotation) matches(asset, stream string) bool {
+	if a.Asset == "" && a.Stream == "" || asset == "" && stream == "" {
+		return true
+	}
+	return a.Stream != "" && a.Stream == stream || a.Asset != "" && a.Asset == asset
+}
+
+// overlaps reports whether the annotation overlaps from to to, a zero bound is open.
+func (a annotation) overlaps(from, to time.Time) bool {
+	return (to.IsZero() || !a.Start.After(to)) && (from.IsZero() || !a.End.Before(from))
+}
+
+// annotationStore keeps the annotations, they label the data for the
+// training of the models. They are appended to a file as JSON lines, one
+// per annotation, and read back on start. Without file they are kept in
+// memory only, as in the tests.
+type annotationStore struct {
+	path string
+
+	lock        sync.Mutex
+	file        *os.File
+	annotations []annotation
+	nextID      int
+}
+
+func openAnnotationStore(path string) (*annotationStore, error) {
+	var as = &annotationStore{path: path, nextID: 1}
+	if path == "" {
+		return as, nil
+	}
+
+	if err := as.load(); err != nil {
+		return nil, err
+	}
+	var err error
+	if as.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	if err = as.endLine(); err != nil {
+		as.file.Close()
+		return nil, err
+	}
+	return as, nil
+}
+
+// endLine ends a last line cut short by a crash, the next annotation starts
+// on a line of its own.
+func (as *annotationStore) endLine() error {
+	fi, err := as.file.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	var last = make([]byte, 1)
+	if _, err = as.file.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = as.file.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// load reads the annotations of the file, if there is one.
+func (as *annotationStore) load() error {
+	f, err := os.Open(as.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var sc = bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var a annotation
+		if err := json.Unmarshal(sc.Bytes(), &a); err != nil {
+			// e.g. the last line of a crash
+			log.Printf("Annotations %s:%d: %s, skipping it\n", as.path, line, err)
+			continue
+		}
+		as.annotations = append(as.annotations, a)
+		if a.ID >= as.nextID {
+			as.nextID = a.ID + 1
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return fmt.Errorf("annotations %s: %s", as.path, err)
+	}
+	if len(as.annotations) > 0 {
+		log.Printf("Annotations %s: %d from before\n", as.path, len(as.annotations))
+	}
+	return nil
+}
+
+// Add stores an annotation.
+func (as *annotationStore) Add(a annotation) (annotation, error) {
+	if a.Text == "" {
+		return a, errAnnotationText
+	}
+	if a.Start.IsZero() {
+		a.Start = time.Now()
+	}
+	if a.End.IsZero() {
+		a.End = a.Start
+	}
+	if a.End.Before(a.Start) {
+		return a, errAnnotationRange
+	}
+	if a.Source == "" {
+		a.Source = "api"
+	}
+
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	a.ID = as.nextID
+	if err := as.write(a); err != nil {
+		return a, err
+	}
+	as.nextID++
+	as.annotations = append(as.annotations, a)
+	return a, nil
+}
+
+// write appends the annotation to the file, with the lock held.
+func (as *annotationStore) write(a annotation) error {
+	if as.file == nil {
+		return nil
+	}
+
+	var started = time.Now()
+	defer func() { storageWrites.WithLabelValues("annotations").Observe(time.Since(started).Seconds()) }()
+
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if _, err = as.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return as.file.Sync()
+}
+
+// Close closes the file, on shutdown.
+func (as *annotationStore) Close() error {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	if as.file == nil {
+		return nil
+	}
+	var err = as.file.Close()
+	as.file = nil
+	return err
+}
+
+// Between returns the annotations of an asset or a stream that overlap from
+// to to, by start.
+func (as *annotationStore) Between(asset, stream string, from, to time.Time) []annotation {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+
+	var found = []annotation{}
+	for _, a := range as.annotations {
+		if a.matches(asset, stream) && a.overlaps(from, to) {
+			found = append(found, a)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Start.Before(found[j].Start) })
+	return found
+}
+
+// Observe is registered as observer of the broker, after the alarm tracker.
+func (as *annotationStore) Observe(r reading) {
+	if r.Event != "alarm_acknowledged" {
+		return
+	}
+	var _, err = as.Add(annotation{
+		Asset:  r.Asset,
+		Stream: r.stream(),
+		Start:  r.PublishedAt,
+		Text:   "alarm acknowledged by " + r.Data,
+		By:     r.Data,
+		Source: "alarm",
+	})
+	if err != nil {
+		log.Printf("Annotating the acknowledgement of %s: %s\n", r.stream(), err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnnotationStore(t *testing.T) {
+	as, err := openAnnotationStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var day = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	bearing, err := as.Add(annotation{Asset: "gearbox-1", Start: day.Add(8 * time.Hour), End: day.Add(10 * time.Hour), Text: "bearing replaced"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bearing.Source != "api" || bearing.ID == 0 {
+		t.Errorf("got annotation %v", bearing)
+	}
+	as.Add(annotation{Stream: "edge1/7/temperature", Start: day.Add(12 * time.Hour), Text: "probe moved"})
+	as.Add(annotation{Start: day.Add(9 * time.Hour), Text: "power cut"})
+	as.Add(annotation{Asset: "press", Start: day.Add(9 * time.Hour), Text: "oil changed"})
+
+	if _, err = as.Add(annotation{Start: day}); err == nil {
+		t.Error("annotation without text accepted")
+	}
+	if _, err = as.Add(annotation{Start: day, End: day.Add(-time.Hour), Text: "x"}); err == nil {
+		t.Error("annotation ending before its start accepted")
+	}
+
+	var texts = func(as []annotation) []string {
+		var ts []string
+		for _, a := range as {
+			ts = append(ts, a.Text)
+		}
+		return ts
+	}
+
+	var got = texts(as.Between("gearbox-1", "edge1/7/temperature", day.Add(9*time.Hour+30*time.Minute), time.Time{}))
+	if len(got) != 2 || got[0] != "bearing replaced" || got[1] != "probe moved" {
+		t.Errorf("got annotations %v", got)
+	}
+	got = texts(as.Between("gearbox-1", "", day, day.Add(11*time.Hour)))
+	if len(got) != 2 || got[0] != "bearing replaced" || got[1] != "power cut" {
+		t.Errorf("got annotations %v", got)
+	}
+	if got = texts(as.Between("", "", time.Time{}, time.Time{})); len(got) != 4 {
+		t.Errorf("got annotations %v", got)
+	}
+
+	// neither the press nor another stream of the gearbox
+	got = texts(as.Between("", "edge1/7/temperature", time.Time{}, time.Time{}))
+	if len(got) != 2 || got[0] != "power cut" || got[1] != "probe moved" {
+		t.Errorf("got annotations %v of the stream", got)
+	}
+	got = texts(as.Between("gearbox-1", "edge1/8/temperature", time.Time{}, time.Time{}))
+	if len(got) != 2 || got[0] != "bearing replaced" || got[1] != "power cut" {
+		t.Errorf("got annotations %v of another stream", got)
+	}
+	got = texts(as.Between("press", "", time.Time{}, time.Time{}))
+	if len(got) != 2 || got[0] != "power cut" || got[1] != "oil changed" {
+		t.Errorf("got annotations %v of the press", got)
+	}
+}
+
+func TestAnnotationStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "annotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "annotations.jsonl")
+
+	as, err := openAnnotationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start = time.Date(2019, 6, 1, 8, 0, 0, 0, time.UTC)
+	as.Add(annotation{Asset: "gearbox-1", Start: start, End: start.Add(time.Hour), Text: "bearing replaced", By: "anna"})
+	as.Add(annotation{Asset: "gearbox-1", Start: start.Add(2 * time.Hour), Text: "oil changed"})
+	if err = as.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a line cut short by a crash
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"id": 3, "te`)
+	f.Close()
+
+	if as, err = openAnnotationStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer as.Close()
+	var found = as.Between("gearbox-1", "", time.Time{}, time.Time{})
+	if len(found) != 2 || found[0].Text != "bearing replaced" || found[0].By != "anna" || !found[0].End.Equal(start.Add(time.Hour)) {
+		t.Fatalf("got annotations %+v after the restart", found)
+	}
+
+	a, err := as.Add(annotation{Text: "power cut"})
+	if err != nil || a.ID != 3 {
+		t.Errorf("got annotation %+v, %v", a, err)
+	}
+
+	// not glued to the cut line
+	as.Close()
+	if as, err = openAnnotationStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if found = as.Between("", "", time.Time{}, time.Time{}); len(found) != 3 || found[2].Text != "power cut" {
+		t.Errorf("got annotations %+v after another restart", found)
+	}
+}
+
+func TestAnnotationStoreAcknowledgements(t *testing.T) {
+	var broker = NewSSEBroker()
+	var alarms = newAlarmTracker(broker)
+	broker.AddObserver(alarms.Observe)
+	as, _ := openAnnotationStore("")
+	broker.AddObserver(as.Observe)
+
+	var r = reading{Hostname: "edge1", SensorID: 1, Quantity: "temperature", Asset: "gearbox-1", Reading: 30.0, MaxAlarm: 25}
+	broker.NewReading(r)
+	if err := alarms.Acknowledge(r.stream(), "anna"); err != nil {
+		t.Fatal(err)
+	}
+
+	var found = as.Between("", r.stream(), time.Time{}, time.Time{})
+	if len(found) != 1 || found[0].Text != "alarm acknowledged by anna" || found[0].Source != "alarm" || found[0].Start.IsZero() {
+		t.Errorf("got annotations %v", found)
+	}
+}
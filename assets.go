@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// assetRegistry names the machine, e.g. a gearbox or a press, the sensors are
+// mounted on. A sensor is configured by SensorID, or as hostname/SensorID
+// if the SensorID alone is ambiguous.
+type assetRegistry struct {
+	byHostSensor map[string]string // hostname/sensorID to asset
+	bySensor     map[string]string // sensorID to asset
+}
+
+func newAssetRegistry(assets map[string][]string) *assetRegistry {
+	var ar = &assetRegistry{
+		byHostSensor: make(map[string]string),
+		bySensor:     make(map[string]string),
+	}
+	for asset, sensors := range assets {
+		for _, sensor := range sensors {
+			if strings.Contains(sensor, "/") {
+				ar.byHostSensor[sensor] = asset
+			} else {
+				ar.bySensor[sensor] = asset
+			}
+		}
+	}
+	return ar
+}
+
+// Asset returns the asset of a sensor, an empty string if it has none.
+func (ar *assetRegistry) Asset(hostname string, sensorID uint32) string {
+	var sensor = strconv.FormatUint(uint64(sensorID), 10)
+	if asset, ok := ar.byHostSensor[hostname+"/"+sensor]; ok {
+		return asset
+	}
+	return ar.bySensor[sensor]
+}
+
+// Tag is registered as filter of the broker, it stamps the asset on the
+// readings that do not bring one.
+func (ar *assetRegistry) Tag(r *reading) bool {
+	if r.Asset == "" {
+		r.Asset = ar.Asset(r.Hostname, r.SensorID)
+	}
+	return true
+}
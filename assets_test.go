@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestAssetRegistry(t *testing.T) {
+	var ar = newAssetRegistry(map[string][]string{
+		"gearbox-1": {"2311"},
+		"press":     {"edge1/2311", "42"},
+	})
+
+	for _, c := range []struct {
+		hostname string
+		sensorID uint32
+		want     string
+	}{
+		{"edge2", 2311, "gearbox-1"},
+		{"edge1", 2311, "press"},
+		{"edge1", 42, "press"},
+		{"edge1", 43, ""},
+	} {
+		if asset := ar.Asset(c.hostname, c.sensorID); asset != c.want {
+			t.Errorf("%s/%d on %q, want %q", c.hostname, c.sensorID, asset, c.want)
+		}
+	}
+
+	var r = reading{Hostname: "edge1", SensorID: 42, Asset: "lathe"}
+	if !ar.Tag(&r) || r.Asset != "lathe" {
+		t.Errorf("asset of the reading replaced by %q", r.Asset)
+	}
+}
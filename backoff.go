@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// backoff doubles the wait between two reconnect attempts up to a maximum.
+type backoff struct {
+	min  time.Duration
+	max  time.Duration
+	next time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, next: min}
+}
+
+// Wait sleeps for the current backoff and doubles it. It returns false
+// if the context was cancelled while waiting.
+func (b *backoff) Wait(ctx context.Context) bool {
+	var t = time.NewTimer(b.next)
+	defer t.Stop()
+
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Next is the wait of the next call to Wait.
+func (b *backoff) Next() time.Duration {
+	return b.next
+}
+
+// Reset starts over with the minimum wait.
+func (b *backoff) Reset() {
+	b.next = b.min
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// errBLEDisconnected is returned when a peripheral drops the connection.
+var errBLEDisconnected = errors.New("disconnected")
+
+// errNoRSSI is returned by the backends that cannot read the signal
+// strength of a connection.
+var errNoRSSI = errors.New("no RSSI of the connection")
+
+// bleAdvertisement is what a scan reports about a peripheral.
+type bleAdvertisement struct {
+	Address          string
+	LocalName        string
+	RSSI             int
+	ManufacturerData []byte            // starts with the company identifier, little endian
+	ServiceData      map[string][]byte // by normalised service UUID
+}
+
+// BLEBackend is the bluetooth stack the BLE collector talks to.
+type BLEBackend interface {
+	// Scan reports advertisements until the context is cancelled.
+	Scan(ctx context.Context, found func(bleAdvertisement)) error
+
+	// Connect connects the peripheral with the given address.
+	Connect(ctx context.Context, address string) (BLEPeripheral, error)
+
+	// Close releases the adapter, after the scans and connections ended.
+	Close() error
+}
+
+// BLEPeripheral is a connected peripheral. Characteristics are named by
+// their UUID, see normalizeUUID.
+type BLEPeripheral interface {
+	// Discover finds the characteristics of the peripheral and returns their UUIDs.
+	Discover() ([]string, error)
+
+	Read(char string) ([]byte, error)
+	Write(char string, value []byte) error
+
+	// Subscribe enables the notifications of the characteristic, fn is called with every value.
+	Subscribe(char string, fn func([]byte)) error
+
+	// RSSI returns the signal strength of the connection in dBm, or errNoRSSI.
+	RSSI() (int, error)
+
+	// Disconnected is closed when the connection is lost.
+	Disconnected() <-chan struct{}
+
+	Close() error
+}
+
+// bluetoothBaseUUID completes the 16 bit UUIDs of the Bluetooth SIG.
+const bluetoothBaseUUID = "00001000800000805f9b34fb"
+
+// normalizeUUID returns the 128 bit form of a UUID in lower case without
+// dashes, so 2902, 00002902-0000-1000-8000-00805F9B34FB and
+// 0000290200001000800000805f9b34fb are the same.
+func normalizeUUID(uuid string) string {
+	uuid = strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	if len(uuid) == 4 {
+		return "0000" + uuid + bluetoothBaseUUID
+	}
+	return uuid
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SensorTypes of the readings decoded from advertisements.
+const (
+	stRuuviTag uint16 = 0xab00
+	stXiaomi   uint16 = 0xab01 // LYWSD03MMC and friends with ATC or pvvx firmware
+)
+
+// beaconStale is how long a beacon may be silent before it counts as disconnected.
+const beaconStale = time.Minute
+
+// advertisementDecoder reads sensor values from an advertisement.
+// It returns false if the advertisement is not in its format.
+type advertisementDecoder struct {
+	name       string
+	sensorType uint16
+	decode     func(a bleAdvertisement) ([]sample, bool)
+}
+
+var advertisementDecoders = []*advertisementDecoder{
+	{name: "ruuvitag", sensorType: stRuuviTag, decode: decodeRuuviTag},
+	{name: "xiaomi", sensorType: stXiaomi, decode: decodeXiaomi},
+}
+
+// decodeAdvertisement tries all decoders on the advertisement.
+func decodeAdvertisement(a bleAdvertisement) (*advertisementDecoder, []sample, bool) {
+	for _, d := range advertisementDecoders {
+		if samples, ok := d.decode(a); ok {
+			return d, samples, true
+		}
+	}
+	return nil, nil, false
+}
+
+// ruuviCompanyID is the Bluetooth company identifier of Ruuvi Innovations.
+const ruuviCompanyID = 0x0499
+
+// decodeRuuviTag decodes the RuuviTag data formats 3 (RAWv1) and 5 (RAWv2)
+// from the manufacturer data.
+func decodeRuuviTag(a bleAdvertisement) ([]sample, bool) {
+	var md = a.ManufacturerData
+	if len(md) < 3 || binary.LittleEndian.Uint16(md) != ruuviCompanyID {
+		return nil, false
+	}
+
+	var b = md[2:]
+	switch {
+	case b[0] == 3 && len(b) >= 14:
+		// the temperature is a sign bit, 7 bits of integer and a byte of hundredths
+		var temp = float64(b[2]&0x7f) + float64(b[3])/100
+		if b[2]&0x80 != 0 {
+			temp = -temp
+		}
+
+		return []sample{
+			{Quantity: "temperature", Unit: "°C", Value: temp},
+			{Quantity: "humidity", Unit: "%RH", Value: float64(b[1]) * 0.5},
+			{Quantity: "pressure", Unit: "hPa", Value: (float64(binary.BigEndian.Uint16(b[4:])) + 50000) / 100},
+			{Quantity: "acceleration_x", Unit: "g", Value: float64(int16(binary.BigEndian.Uint16(b[6:]))) / 1000},
+			{Quantity: "acceleration_y", Unit: "g", Value: float64(int16(binary.BigEndian.Uint16(b[8:]))) / 1000},
+			{Quantity: "acceleration_z", Unit: "g", Value: float64(int16(binary.BigEndian.Uint16(b[10:]))) / 1000},
+			{Quantity: "battery_voltage", Unit: "V", Value: float64(binary.BigEndian.Uint16(b[12:])) / 1000},
+		}, true
+
+	case b[0] == 5 && len(b) >= 24:
+		var samples []sample
+
+		// the maximum of each field means not available
+		if raw := int16(binary.BigEndian.Uint16(b[1:])); raw != math.MinInt16 {
+			samples = append(samples, sample{Quantity: "temperature", Unit: "°C", Value: float64(raw) * 0.005})
+		}
+		if raw := binary.BigEndian.Uint16(b[3:]); raw != math.MaxUint16 {
+			samples = append(samples, sample{Quantity: "humidity", Unit: "%RH", Value: float64(raw) * 0.0025})
+		}
+		if raw := binary.BigEndian.Uint16(b[5:]); raw != math.MaxUint16 {
+			samples = append(samples, sample{Quantity: "pressure", Unit: "hPa", Value: (float64(raw) + 50000) / 100})
+		}
+		for i, axis := range []string{"x", "y", "z"} {
+			if raw := int16(binary.BigEndian.Uint16(b[7+i*2:])); raw != math.MinInt16 {
+				samples = append(samples, sample{Quantity: "acceleration_" + axis, Unit: "g", Value: float64(raw) / 1000})
+			}
+		}
+		if power := binary.BigEndian.Uint16(b[13:]); power>>5 != 0x7ff {
+			samples = append(samples, sample{Quantity: "battery_voltage", Unit: "V", Value: float64(power>>5+1600) / 1000})
+		}
+
+		return samples, len(samples) > 0
+	}
+
+	return nil, false
+}
+
+// environmentalSensingUUID is the service data UUID the ATC and pvvx firmwares advertise with.
+var environmentalSensingUUID = normalizeUUID("181a")
+
+// decodeXiaomi decodes the service data of Xiaomi thermometers flashed with
+// the ATC1441 (13 bytes, big endian) or pvvx (15 bytes, little endian) firmware.
+// The encrypted MiBeacon format of the stock firmware is not supported.
+func decodeXiaomi(a bleAdvertisement) ([]sample, bool) {
+	var b = a.ServiceData[environmentalSensingUUID]
+
+	switch len(b) {
+	case 13:
+		return []sample{
+			{Quantity: "temperature", Unit: "°C", Value: float64(int16(binary.BigEndian.Uint16(b[6:]))) / 10},
+			{Quantity: "humidity", Unit: "%RH", Value: float64(b[8])},
+			{Quantity: "battery", Unit: "%", Value: float64(b[9])},
+			{Quantity: "battery_voltage", Unit: "V", Value: float64(binary.BigEndian.Uint16(b[10:])) / 1000},
+		}, true
+
+	case 15:
+		return []sample{
+			{Quantity: "temperature", Unit: "°C", Value: float64(int16(binary.LittleEndian.Uint16(b[6:]))) / 100},
+			{Quantity: "humidity", Unit: "%RH", Value: float64(binary.LittleEndian.Uint16(b[8:])) / 100},
+			{Quantity: "battery_voltage", Unit: "V", Value: float64(binary.LittleEndian.Uint16(b[10:])) / 1000},
+			{Quantity: "battery", Unit: "%", Value: float64(b[12])},
+		}, true
+	}
+
+	return nil, false
+}
+
+// beaconScanner reads sensors from their advertisements without connecting them.
+// Only the addresses on the allow-list are decoded. With several adapters a
+// beacon is read through the one that receives it best.
+type beaconScanner struct {
+	hostnamePlus string
+	adapters     []bleAdapter
+	allowed      map[string]bool // upper case addresses
+	interval     time.Duration   // minimum time between two readings of a beacon
+	receivers    *rssiSelector   // adapter by address
+	sseBroker    *SSEBroker
+	devices      *deviceRegistry
+	telemetry    *wirelessTelemetry
+
+	lock     sync.Mutex
+	lastSeen map[string]time.Time // by address, last published advertisement
+}
+
+func newBeaconScanner(cfg *config, adapters []bleAdapter, sseBroker *SSEBroker, devices *deviceRegistry, telemetry *wirelessTelemetry) *beaconScanner {
+	var allowed = make(map[string]bool)
+	for _, address := range cfg.BLE.Beacons {
+		allowed[strings.ToUpper(address)] = true
+	}
+
+	return &beaconScanner{
+		hostnamePlus: cfg.Hostname,
+		adapters:     adapters,
+		allowed:      allowed,
+		interval:     time.Duration(cfg.BLE.Interval) * time.Millisecond,
+		receivers:    newRSSISelector(rssiHandoverMargin, beaconStale),
+		sseBroker:    sseBroker,
+		devices:      devices,
+		telemetry:    telemetry,
+		lastSeen:     make(map[string]time.Time),
+	}
+}
+
+// Run scans on all adapters until the context is cancelled.
+func (bs *beaconScanner) Run(ctx context.Context) {
+	go bs.sweep(ctx)
+
+	var wg = sync.WaitGroup{}
+	for _, adapter := range bs.adapters {
+		wg.Add(1)
+		go func(adapter bleAdapter) {
+			defer wg.Done()
+			bs.scan(ctx, adapter)
+		}(adapter)
+	}
+	wg.Wait()
+}
+
+// scan scans on one adapter, a failed scan is retried with a backoff.
+func (bs *beaconScanner) scan(ctx context.Context, adapter bleAdapter) {
+	var bo = newBackoff(bleMinBackoff, bleMaxBackoff)
+	for {
+		var started = time.Now()
+		var err = adapter.backend.Scan(ctx, func(a bleAdvertisement) {
+			adapter.state.Up()
+			bs.advertisement(adapter.id, a)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		adapter.state.Down(err)
+
+		if time.Since(started) > bleMaxBackoff {
+			bo.Reset()
+		}
+
+		collectorReconnects.WithLabelValues("beacons").Inc()
+		log.Printf("Scanning on %s: %v, retrying in %s\n", adapter.id, err, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// advertisement publishes the values of an allowed beacon, at most once per
+// interval, if the adapter receives it best.
+func (bs *beaconScanner) advertisement(adapterID string, a bleAdvertisement) {
+	var address = strings.ToUpper(a.Address)
+	if !bs.allowed[address] {
+		return
+	}
+
+	d, samples, ok := decodeAdvertisement(a)
+	if !ok {
+		return
+	}
+
+	var at = time.Now()
+	if !bs.receivers.Offer(address, adapterID, a.RSSI, at) {
+		return
+	}
+
+	bs.lock.Lock()
+	last, known := bs.lastSeen[address]
+	if known && at.Sub(last) < bs.interval {
+		bs.lock.Unlock()
+		return
+	}
+	bs.lastSeen[address] = at
+	bs.lock.Unlock()
+
+	var sensorID = sensorIDFromAddress(address)
+	if !known {
+		bs.devices.Connected(address, d.name, bs.hostnamePlus, adapterID, sensorID)
+	}
+
+	bs.telemetry.RSSI(address, sensorID, d.sensorType, a.RSSI, at)
+
+	for _, sm := range samples {
+		bs.devices.Reading(address, at)
+
+		// the battery goes with the telemetry, so it carries the low battery alarm
+		switch sm.Quantity {
+		case "battery":
+			bs.telemetry.Battery(address, sensorID, d.sensorType, sm.Value, at)
+			continue
+		case "battery_voltage":
+			bs.telemetry.BatteryVoltage(address, sensorID, d.sensorType, sm.Value, at)
+			continue
+		}
+
+		bs.sseBroker.NewReading(reading{
+			Hostname:    bs.hostnamePlus,
+			SensorID:    sensorID,
+			SensorType:  d.sensorType,
+			Reading:     sm.Value,
+			Quantity:    sm.Quantity,
+			Unit:        sm.Unit,
+			Data:        strconv.FormatFloat(sm.Value, 'f', -1, 64),
+			PublishedAt: at,
+		})
+	}
+}
+
+// sweep marks beacons that went silent as disconnected.
+func (bs *beaconScanner) sweep(ctx context.Context) {
+	var ticker = time.NewTicker(beaconStale / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bs.lock.Lock()
+		for address, last := range bs.lastSeen {
+			if time.Since(last) > beaconStale {
+				delete(bs.lastSeen, address)
+				bs.devices.Disconnected(address)
+			}
+		}
+		bs.lock.Unlock()
+	}
+}
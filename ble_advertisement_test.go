@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func manufacturerData(t *testing.T, s string) bleAdvertisement {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bleAdvertisement{ManufacturerData: b}
+}
+
+func TestDecodeRuuviTagRAWv2(t *testing.T) {
+	// test vector of the data format 5 specification
+	d, samples, ok := decodeAdvertisement(manufacturerData(t, "99040512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F"))
+	if !ok || d.sensorType != stRuuviTag {
+		t.Fatal("not decoded as RuuviTag")
+	}
+
+	var vs = values(samples)
+	if !near(vs["temperature"], 24.3) || !near(vs["humidity"], 53.49) || !near(vs["pressure"], 1000.44) ||
+		!near(vs["acceleration_z"], 1.036) || !near(vs["battery_voltage"], 2.977) {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeRuuviTagRAWv1(t *testing.T) {
+	// test vector of the data format 3 specification
+	_, samples, ok := decodeAdvertisement(manufacturerData(t, "990403291A1ECE1EFC18F94202CA0B53"))
+	if !ok {
+		t.Fatal("not decoded")
+	}
+
+	var vs = values(samples)
+	if !near(vs["temperature"], 26.3) || !near(vs["humidity"], 20.5) || !near(vs["pressure"], 1027.66) ||
+		!near(vs["acceleration_x"], -1) || !near(vs["battery_voltage"], 2.899) {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeXiaomiATC(t *testing.T) {
+	// 23.4 °C, 45 %RH, 87 %, 2.95 V
+	b, _ := hex.DecodeString("A4C13812345600EA2D570B8612")
+	d, samples, ok := decodeAdvertisement(bleAdvertisement{
+		ServiceData: map[string][]byte{normalizeUUID("0000181a-0000-1000-8000-00805f9b34fb"): b},
+	})
+	if !ok || d.sensorType != stXiaomi {
+		t.Fatal("not decoded as Xiaomi")
+	}
+
+	var vs = values(samples)
+	if !near(vs["temperature"], 23.4) || vs["humidity"] != 45 || vs["battery"] != 87 || !near(vs["battery_voltage"], 2.95) {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeUnknownAdvertisement(t *testing.T) {
+	if _, _, ok := decodeAdvertisement(manufacturerData(t, "4c000215")); ok {
+		t.Error("iBeacon decoded")
+	}
+}
+
+func TestBeaconScannerAllowList(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.BLE.Beacons = []string{"cb:b8:33:4c:88:4f"}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte, 100)
+	broker.AddClient(ch)
+
+	var devices = newDeviceRegistry()
+	var bs = newBeaconScanner(cfg, []bleAdapter{{id: "hci0", backend: newFakeBackend()}}, broker, devices, newWirelessTelemetry(cfg, broker, devices))
+
+	var adv = manufacturerData(t, "99040512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F")
+	adv.Address = "AA:BB:CC:DD:EE:FF"
+	bs.advertisement("hci0", adv)
+
+	adv.Address = "CB:B8:33:4C:88:4F"
+	bs.advertisement("hci0", adv)
+	// within the interval
+	bs.advertisement("hci0", adv)
+
+	var ds = bs.devices.Devices()
+	if len(ds) != 1 || ds[0].ID != "CB:B8:33:4C:88:4F" || ds[0].Readings != 7 {
+		t.Errorf("got %+v", ds)
+	}
+}
+
+func TestBeaconScannerBattery(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.BLE.Beacons = []string{"A4:C1:38:12:34:56", "CB:B8:33:4C:88:4F"}
+	cfg.BLE.Interval = 0
+
+	var broker = NewSSEBroker()
+	var devices = newDeviceRegistry()
+	var bs = newBeaconScanner(cfg, nil, broker, devices, newWirelessTelemetry(cfg, broker, devices))
+
+	// the level and the voltage, in either order
+	for _, frame := range []string{"A4C13812345600EA2D570B8612", "56341238C1A424099411860B570000"} {
+		b, _ := hex.DecodeString(frame)
+		bs.advertisement("hci0", bleAdvertisement{
+			Address:     "A4:C1:38:12:34:56",
+			ServiceData: map[string][]byte{environmentalSensingUUID: b},
+		})
+	}
+	// only the voltage
+	var adv = manufacturerData(t, "99040512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F")
+	adv.Address = "CB:B8:33:4C:88:4F"
+	bs.advertisement("hci0", adv)
+
+	var ds = devices.Devices()
+	if len(ds) != 2 || ds[0].Battery == nil || *ds[0].Battery != 87 || ds[0].BatteryUnit != "%" {
+		t.Errorf("got %+v", ds)
+	}
+	if ds[1].Battery == nil || !near(*ds[1].Battery, 2.977) || ds[1].BatteryUnit != "V" {
+		t.Errorf("got %+v", ds[1])
+	}
+}
+
+func TestBeaconScannerBestAdapter(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.BLE.Beacons = []string{"CB:B8:33:4C:88:4F"}
+	cfg.BLE.Interval = 0
+
+	var broker = NewSSEBroker()
+	var devices = newDeviceRegistry()
+	var bs = newBeaconScanner(cfg, nil, broker, devices, newWirelessTelemetry(cfg, broker, devices))
+
+	var adv = manufacturerData(t, "99040512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F")
+	adv.Address = "CB:B8:33:4C:88:4F"
+
+	adv.RSSI = -80
+	bs.advertisement("hci0", adv)
+	adv.RSSI = -60
+	bs.advertisement("hci1", adv)
+	// hci0 is now the weaker adapter
+	adv.RSSI = -78
+	bs.advertisement("hci0", adv)
+
+	var ds = devices.Devices()
+	if len(ds) != 1 || ds[0].Readings != 14 || ds[0].RSSI == nil || *ds[0].RSSI != -60 {
+		t.Errorf("got %+v", ds)
+	}
+}
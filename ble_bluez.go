@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/muka/go-bluetooth/api"
+	"github.com/muka/go-bluetooth/bluez/profile"
+)
+
+// bluezBackend talks to BlueZ over D-Bus. The scans share one discovery
+// on the adapter, it runs while there are scans.
+type bluezBackend struct {
+	adapterID string
+
+	lock     sync.Mutex
+	scans    map[int]func(bleAdvertisement)
+	nextScan int
+	signals  chan *dbus.Signal // of the running discovery
+	stop     context.CancelFunc
+}
+
+func newBluezBackend(adapterID string) (*bluezBackend, error) {
+	if err := api.TurnOnAdapter(adapterID); err != nil {
+		return nil, err
+	}
+
+	if err := api.TurnOnBluetooth(); err != nil {
+		return nil, err
+	}
+
+	return &bluezBackend{
+		adapterID: adapterID,
+		scans:     make(map[int]func(bleAdvertisement)),
+	}, nil
+}
+
+// devices returns the devices BlueZ knows through this adapter, with several
+// adapters each has its own copy under /org/bluez/<adapter>/.
+func (bb *bluezBackend) devices() ([]*api.Device, error) {
+	devs, err := api.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix = "/org/bluez/" + bb.adapterID + "/"
+	var own []*api.Device
+	for _, dev := range devs {
+		if strings.HasPrefix(string(dev.Path), prefix) {
+			own = append(own, dev)
+		}
+	}
+	return own, nil
+}
+
+// device returns the device with the address, nil if the adapter has not seen it.
+func (bb *bluezBackend) device(address string) (*api.Device, error) {
+	devs, err := bb.devices()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dev := range devs {
+		props, err := dev.GetProperties()
+		if err == nil && strings.EqualFold(props.Address, address) {
+			return dev, nil
+		}
+	}
+	return nil, nil
+}
+
+// Scan reports the advertisements until the context is cancelled. BlueZ
+// signals the changes of the devices it discovers, a device is reported when
+// it appears and when its RSSI or its advertised data changes, the cached
+// devices are not polled as they keep their last values after they went
+// silent.
+func (bb *bluezBackend) Scan(ctx context.Context, found func(bleAdvertisement)) error {
+	bb.lock.Lock()
+	if len(bb.scans) == 0 {
+		if err := bb.startDiscovery(); err != nil {
+			bb.lock.Unlock()
+			return err
+		}
+	}
+	var id = bb.nextScan
+	bb.nextScan++
+	bb.scans[id] = found
+	bb.lock.Unlock()
+
+	<-ctx.Done()
+
+	bb.lock.Lock()
+	delete(bb.scans, id)
+	if len(bb.scans) == 0 {
+		bb.stopDiscovery()
+	}
+	bb.lock.Unlock()
+
+	return nil
+}
+
+// The signals of the devices of a discovery.
+const (
+	bluezDeviceChanged = "type='signal',sender='org.bluez',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged'"
+	bluezDeviceAdded   = "type='signal',sender='org.bluez',interface='org.freedesktop.DBus.ObjectManager',member='InterfacesAdded'"
+)
+
+// startDiscovery starts the discovery and the dispatch of its signals, with the lock held.
+func (bb *bluezBackend) startDiscovery() error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	for _, rule := range []string{bluezDeviceChanged, bluezDeviceAdded} {
+		if call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule); call.Err != nil {
+			return call.Err
+		}
+	}
+	var signals = make(chan *dbus.Signal, 100)
+	conn.Signal(signals)
+
+	if err = api.StartDiscoveryOn(bb.adapterID); err != nil {
+		conn.RemoveSignal(signals)
+		return err
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	bb.signals, bb.stop = signals, cancel
+	go bb.dispatch(ctx, signals)
+	return nil
+}
+
+// stopDiscovery stops the discovery, with the lock held.
+func (bb *bluezBackend) stopDiscovery() {
+	bb.stop()
+	if conn, err := dbus.SystemBus(); err == nil {
+		conn.RemoveSignal(bb.signals)
+		for _, rule := range []string{bluezDeviceChanged, bluezDeviceAdded} {
+			conn.BusObject().Call("org.freedesktop.DBus.RemoveMatch", 0, rule)
+		}
+	}
+	api.StopDiscoveryOn(bb.adapterID)
+}
+
+// dispatch reports the devices the signals are about to the scans.
+func (bb *bluezBackend) dispatch(ctx context.Context, signals chan *dbus.Signal) {
+	var prefix = "/org/bluez/" + bb.adapterID + "/"
+	for {
+		var sig *dbus.Signal
+		select {
+		case <-ctx.Done():
+			return
+		case sig = <-signals:
+		}
+
+		var path, ok = advertisedDevice(sig)
+		if !ok || !strings.HasPrefix(string(path), prefix) {
+			continue
+		}
+		adv, err := bb.advertisement(path)
+		if err != nil {
+			continue
+		}
+
+		bb.lock.Lock()
+		var scans = make([]func(bleAdvertisement), 0, len(bb.scans))
+		for _, fn := range bb.scans {
+			scans = append(scans, fn)
+		}
+		bb.lock.Unlock()
+
+		for _, fn := range scans {
+			fn(adv)
+		}
+	}
+}
+
+// advertisedDevice returns the device a signal reports an advertisement of:
+// a device that appeared, or one whose RSSI, manufacturer or service data
+// changed.
+func advertisedDevice(sig *dbus.Signal) (dbus.ObjectPath, bool) {
+	if sig == nil || len(sig.Body) < 2 {
+		return "", false
+	}
+
+	switch sig.Name {
+	case "org.freedesktop.DBus.ObjectManager.InterfacesAdded":
+		path, ok := sig.Body[0].(dbus.ObjectPath)
+		if !ok {
+			return "", false
+		}
+		ifaces, ok := sig.Body[1].(map[string]map[string]dbus.Variant)
+		if !ok {
+			return "", false
+		}
+		_, ok = ifaces["org.bluez.Device1"]
+		return path, ok
+
+	case "org.freedesktop.DBus.Properties.PropertiesChanged":
+		if iface, _ := sig.Body[0].(string); iface != "org.bluez.Device1" {
+			return "", false
+		}
+		changed, ok := sig.Body[1].(map[string]dbus.Variant)
+		if !ok {
+			return "", false
+		}
+		for _, name := range []string{"RSSI", "ManufacturerData", "ServiceData"} {
+			if _, ok := changed[name]; ok {
+				return sig.Path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// advertisement returns what BlueZ knows about the device at the path.
+func (bb *bluezBackend) advertisement(path dbus.ObjectPath) (bleAdvertisement, error) {
+	devs, err := bb.devices()
+	if err != nil {
+		return bleAdvertisement{}, err
+	}
+
+	for _, dev := range devs {
+		if string(dev.Path) != string(path) {
+			continue
+		}
+		props, err := dev.GetProperties()
+		if err != nil {
+			return bleAdvertisement{}, err
+		}
+
+		var adv = bleAdvertisement{
+			Address:     props.Address,
+			LocalName:   props.Name,
+			RSSI:        int(props.RSSI),
+			ServiceData: make(map[string][]byte),
+		}
+		for company, v := range props.ManufacturerData {
+			if b, ok := v.Value().([]byte); ok {
+				adv.ManufacturerData = append([]byte{byte(company), byte(company >> 8)}, b...)
+			}
+		}
+		for uuid, v := range props.ServiceData {
+			if b, ok := v.Value().([]byte); ok {
+				adv.ServiceData[normalizeUUID(uuid)] = b
+			}
+		}
+		return adv, nil
+	}
+	return bleAdvertisement{}, errTagNotFound
+}
+
+// Connect looks the peripheral up in BlueZ, scanning for it if BlueZ has not seen it yet.
+func (bb *bluezBackend) Connect(ctx context.Context, address string) (BLEPeripheral, error) {
+	dev, err := bb.device(address)
+	if err != nil || dev == nil {
+		var scanCtx, cancel = context.WithTimeout(ctx, bleDiscovery)
+		err = bb.Scan(scanCtx, func(a bleAdvertisement) {
+			if strings.EqualFold(a.Address, address) {
+				cancel()
+			}
+		})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("discovery: %s", err)
+		}
+
+		if dev, err = bb.device(address); err != nil {
+			return nil, err
+		}
+		if dev == nil {
+			return nil, errTagNotFound
+		}
+	}
+
+	if err = dev.Connect(); err != nil {
+		return nil, err
+	}
+
+	var bp = &bluezPeripheral{
+		dev:   dev,
+		chars: make(map[string]*profile.GattCharacteristic1),
+		done:  make(chan struct{}),
+	}
+	go bp.watch()
+
+	return bp, nil
+}
+
+// Close does nothing, BlueZ keeps the adapter and the D-Bus connection is
+// shared by the api package.
+func (bb *bluezBackend) Close() error {
+	return nil
+}
+
+// bluezPeripheral is a device connected through BlueZ.
+type bluezPeripheral struct {
+	dev   *api.Device
+	chars map[string]*profile.GattCharacteristic1
+	lock  sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// watch closes done once BlueZ reports the device as disconnected.
+func (bp *bluezPeripheral) watch() {
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-bp.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !bp.dev.IsConnected() {
+			bp.closeOnce.Do(func() { close(bp.done) })
+			return
+		}
+	}
+}
+
+func (bp *bluezPeripheral) Discover() ([]string, error) {
+	list, err := bp.dev.GetAllServicesAndUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids = make([]string, 0, len(list))
+	for _, s := range list {
+		// entries are characteristic:service
+		uuids = append(uuids, normalizeUUID(strings.Split(s, ":")[0]))
+	}
+
+	return uuids, nil
+}
+
+// char returns the characteristic with the UUID, it is looked up once.
+func (bp *bluezPeripheral) char(uuid string) (*profile.GattCharacteristic1, error) {
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+
+	uuid = normalizeUUID(uuid)
+	if c, ok := bp.chars[uuid]; ok {
+		return c, nil
+	}
+
+	c, err := bp.dev.GetCharByUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("characteristic %s not found", uuid)
+	}
+
+	bp.chars[uuid] = c
+	return c, nil
+}
+
+func (bp *bluezPeripheral) Read(uuid string) ([]byte, error) {
+	c, err := bp.char(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return c.ReadValue(nil)
+}
+
+func (bp *bluezPeripheral) Write(uuid string, value []byte) error {
+	c, err := bp.char(uuid)
+	if err != nil {
+		return err
+	}
+	return c.WriteValue(value, nil)
+}
+
+func (bp *bluezPeripheral) Subscribe(uuid string, fn func([]byte)) error {
+	c, err := bp.char(uuid)
+	if err != nil {
+		return err
+	}
+
+	signals, err := c.Register()
+	if err != nil {
+		return err
+	}
+
+	if err = c.StartNotify(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-bp.done:
+				return
+			case sig, ok := <-signals:
+				if !ok {
+					return
+				}
+				if v, ok := notifiedValue(sig); ok {
+					fn(v)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// notifiedValue extracts the new value of a characteristic from a PropertiesChanged signal.
+func notifiedValue(sig *dbus.Signal) ([]byte, bool) {
+	if sig == nil || sig.Name != "org.freedesktop.DBus.Properties.PropertiesChanged" || len(sig.Body) < 2 {
+		return nil, false
+	}
+
+	changed, ok := sig.Body[1].(map[string]dbus.Variant)
+	if !ok {
+		return nil, false
+	}
+
+	v, ok := changed["Value"]
+	if !ok {
+		return nil, false
+	}
+
+	b, ok := v.Value().([]byte)
+	return b, ok
+}
+
+// RSSI is not known on BlueZ, the RSSI property of a device is that of its
+// last advertisement, it goes stale once the device is connected.
+func (bp *bluezPeripheral) RSSI() (int, error) {
+	return 0, errNoRSSI
+}
+
+func (bp *bluezPeripheral) Disconnected() <-chan struct{} {
+	return bp.done
+}
+
+func (bp *bluezPeripheral) Close() error {
+	bp.closeOnce.Do(func() { close(bp.done) })
+	return bp.dev.Disconnect()
+}
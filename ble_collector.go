@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stSensorTag is the SensorType of the readings of a TI SensorTag,
+// it is outside of the Tinkerforge device identifiers.
+const stSensorTag uint16 = 0xaa00
+
+const (
+	bleMinBackoff = 2 * time.Second // first wait after a lost tag
+	bleMaxBackoff = 2 * time.Minute // upper bound for the wait between attempts
+	bleDiscovery  = 5 * time.Second // how long to scan for a tag the backend has not seen yet
+)
+
+var errTagNotFound = errors.New("device not found")
+
+// bleAdapter is a bluetooth adapter opened with a backend.
+type bleAdapter struct {
+	id      string
+	backend BLEBackend
+	state   *componentState // up while it scans, if it is scanned with
+}
+
+// bleCollector streams the sensors of TI SensorTags through BLE adapters.
+// Every tag is handled on its own, a tag out of range does not stop the others.
+// With several adapters a tag that cannot be reached through one is tried
+// through the next.
+type bleCollector struct {
+	hostnamePlus    string
+	adapters        []bleAdapter
+	tagAddresses    []string
+	interval        int                 // notification period in ms
+	movementPeriod  int                 // notification period of the movement sensor in ms, for the vibration
+	services        []*sensorTagService // sensors to switch on
+	vibration       vibrationConfig
+	sseBroker       *SSEBroker
+	devices         *deviceRegistry
+	telemetry       *wirelessTelemetry
+	telemetryPeriod time.Duration // between two telemetry readings of a tag
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newBLECollector(cfg *config, adapters []bleAdapter, sseBroker *SSEBroker, devices *deviceRegistry, telemetry *wirelessTelemetry) *bleCollector {
+	var telemetryPeriod = time.Duration(cfg.BLE.Telemetry) * time.Second
+	if telemetryPeriod <= 0 {
+		telemetryPeriod = time.Minute
+	}
+
+	return &bleCollector{
+		hostnamePlus:    cfg.Hostname,
+		adapters:        adapters,
+		tagAddresses:    cfg.BLE.Tags,
+		interval:        cfg.BLE.Interval,
+		movementPeriod:  cfg.Vibration.Period,
+		services:        enabledSensorTagServices(cfg.BLE.Services),
+		vibration:       cfg.Vibration,
+		sseBroker:       sseBroker,
+		devices:         devices,
+		telemetry:       telemetry,
+		telemetryPeriod: telemetryPeriod,
+		minBackoff:      bleMinBackoff,
+		maxBackoff:      bleMaxBackoff,
+	}
+}
+
+// newBLEBackend opens the adapter with the configured bluetooth stack.
+func newBLEBackend(cfg *config, adapterID string) (BLEBackend, error) {
+	switch cfg.BLE.Backend {
+	case "", "bluez":
+		return newBluezBackend(adapterID)
+	case "gatt":
+		return newGattBackend(adapterID)
+	default:
+		return nil, fmt.Errorf("unknown BLE backend %q", cfg.BLE.Backend)
+	}
+}
+
+// adapterBackend opens the backend of an adapter when it is first used. An
+// adapter that is slow to come up at boot, or missing, fails the scans and
+// connections until it opens, the collectors retry them with their backoff.
+type adapterBackend struct {
+	id    string
+	open  func() (BLEBackend, error)
+	state *componentState
+
+	lock    sync.Mutex
+	backend BLEBackend
+}
+
+// get returns the backend, opening it if it is not open yet.
+func (ab *adapterBackend) get() (BLEBackend, error) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if ab.backend == nil {
+		backend, err := ab.open()
+		if err != nil {
+			ab.state.Down(err)
+			return nil, fmt.Errorf("powering on %s: %s", ab.id, err)
+		}
+		ab.backend = backend
+		ab.state.Up()
+	}
+	return ab.backend, nil
+}
+
+func (ab *adapterBackend) Scan(ctx context.Context, found func(bleAdvertisement)) error {
+	backend, err := ab.get()
+	if err != nil {
+		return err
+	}
+	return backend.Scan(ctx, found)
+}
+
+func (ab *adapterBackend) Connect(ctx context.Context, address string) (BLEPeripheral, error) {
+	backend, err := ab.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Connect(ctx, address)
+}
+
+// Close closes the backend if it was opened.
+func (ab *adapterBackend) Close() error {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if ab.backend == nil {
+		return nil
+	}
+	return ab.backend.Close()
+}
+
+// newBLEAdapters prepares all configured adapters, they are powered on when
+// they are first used.
+func newBLEAdapters(cfg *config) ([]bleAdapter, error) {
+	switch cfg.BLE.Backend {
+	case "", "bluez", "gatt":
+	default:
+		return nil, fmt.Errorf("unknown BLE backend %q", cfg.BLE.Backend)
+	}
+
+	var adapters []bleAdapter
+	for _, id := range cfg.BLE.adapters() {
+		var id = id
+		var state = newComponentState()
+		var backend = &adapterBackend{
+			id:    id,
+			open:  func() (BLEBackend, error) { return newBLEBackend(cfg, id) },
+			state: state,
+		}
+		adapters = append(adapters, bleAdapter{id: id, backend: backend, state: state})
+	}
+	return adapters, nil
+}
+
+// closeBLEAdapters closes all adapters, on shutdown.
+func closeBLEAdapters(adapters []bleAdapter) error {
+	var failed error
+	for _, a := range adapters {
+		if err := a.backend.Close(); err != nil {
+			failed = fmt.Errorf("%s: %s", a.id, err)
+		}
+	}
+	return failed
+}
+
+// bleAdaptersHealth reports the adapters.
+func bleAdaptersHealth(adapters []bleAdapter) healthReporter {
+	return healthFunc(func() []componentHealth {
+		var hs []componentHealth
+		for _, a := range adapters {
+			hs = append(hs, a.state.health("ble_adapter", a.id))
+		}
+		return hs
+	})
+}
+
+// Run reads all SensorTags until the context is cancelled.
+func (bc *bleCollector) Run(ctx context.Context) {
+	var wg = sync.WaitGroup{}
+	for _, address := range bc.tagAddresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			bc.runTag(ctx, address)
+		}(address)
+	}
+	wg.Wait()
+}
+
+// runTag keeps a connection to one SensorTag, reconnecting with an exponential backoff.
+// A failed attempt moves on to the next adapter.
+func (bc *bleCollector) runTag(ctx context.Context, address string) {
+	var bo = newBackoff(bc.minBackoff, bc.maxBackoff)
+	var next = 0
+	for {
+		var adapter = bc.adapters[next]
+		var started = time.Now()
+		var err = bc.session(ctx, address, adapter)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a connection that held for a while starts over with a short wait on the same adapter
+		if time.Since(started) > bc.maxBackoff {
+			bo.Reset()
+		} else {
+			next = (next + 1) % len(bc.adapters)
+		}
+
+		bc.publishFailure(address, err, time.Now())
+		bc.devices.Disconnected(address)
+
+		collectorReconnects.WithLabelValues("ble").Inc()
+		log.Printf("SensorTag %s on %s: %s, reconnecting in %s\n", address, adapter.id, err, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// session connects the SensorTag once and publishes its notifications until
+// the context is cancelled or the tag disconnects.
+func (bc *bleCollector) session(ctx context.Context, address string, adapter bleAdapter) error {
+	p, err := adapter.backend.Connect(ctx, address)
+	if err != nil {
+		return fmt.Errorf("connecting: %s", err)
+	}
+	defer p.Close()
+
+	uuids, err := p.Discover()
+	if err != nil {
+		return err
+	}
+
+	var discovered = make(map[string]bool)
+	for _, uuid := range uuids {
+		discovered[uuid] = true
+	}
+
+	var sensorID = sensorIDFromAddress(address)
+	var va = bc.newVibrationAnalyzer()
+	var enabled = 0
+	for _, s := range bc.services {
+		if !discovered[s.data] {
+			log.Println("SensorTag", address, "has no", s.name, "service")
+			continue
+		}
+
+		if err = bc.enable(p, address, sensorID, s, va); err != nil {
+			return fmt.Errorf("%s: %s", s.name, err)
+		}
+		enabled++
+	}
+
+	if enabled == 0 {
+		return errors.New("no known service")
+	}
+
+	bc.devices.Connected(address, "sensortag", bc.hostnamePlus, adapter.id, sensorID)
+	log.Println("SensorTag", address, "connected on", adapter.id)
+
+	var connectedAt = time.Now()
+	var hasBattery = discovered[batteryLevelUUID]
+	bc.publishTelemetry(p, address, sensorID, hasBattery, connectedAt)
+
+	var ticker = time.NewTicker(bc.telemetryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.Disconnected():
+			return errBLEDisconnected
+		case <-ticker.C:
+			bc.publishTelemetry(p, address, sensorID, hasBattery, connectedAt)
+		}
+	}
+}
+
+// publishTelemetry publishes the RSSI, the battery level if the tag has a
+// battery service and the uptime of the connection.
+func (bc *bleCollector) publishTelemetry(p BLEPeripheral, address string, sensorID uint32, hasBattery bool, connectedAt time.Time) {
+	var at = time.Now()
+
+	if rssi, err := p.RSSI(); err == nil {
+		bc.telemetry.RSSI(address, sensorID, stSensorTag, rssi, at)
+	}
+
+	if hasBattery {
+		b, err := p.Read(batteryLevelUUID)
+		if err == nil && len(b) == 1 {
+			bc.telemetry.Battery(address, sensorID, stSensorTag, float64(b[0]), at)
+		}
+	}
+
+	bc.telemetry.Uptime(sensorID, stSensorTag, connectedAt, at)
+}
+
+// period returns the notification period of a service. The movement sensor
+// notifies with its own period, the sample rate of the vibration analysis.
+// The SensorTag notifies every 100ms at most, the analysis sees up to 5 Hz.
+func (bc *bleCollector) period(s *sensorTagService) byte {
+	if s.name == "movement" {
+		return s.sensorTagPeriod(bc.movementPeriod)
+	}
+	return s.sensorTagPeriod(bc.interval)
+}
+
+// enable configures the period of the sensor, switches it on and publishes its notifications.
+// The movement sensor also feeds the vibration analyzer.
+func (bc *bleCollector) enable(p BLEPeripheral, address string, sensorID uint32, s *sensorTagService, va *vibrationAnalyzer) error {
+	if err := p.Write(s.period, []byte{bc.period(s)}); err != nil {
+		return fmt.Errorf("setting period: %s", err)
+	}
+
+	if err := p.Write(s.config, s.enable); err != nil {
+		return fmt.Errorf("enabling: %s", err)
+	}
+
+	return p.Subscribe(s.data, func(b []byte) {
+		var at = time.Now()
+		samples, err := s.decode(b)
+		if err != nil {
+			bc.publishFailure(address, err, at)
+			return
+		}
+
+		bc.publishSamples(address, sensorID, samples, at)
+
+		if s.name == "movement" {
+			bc.publishVibration(va, address, sensorID, samples, at)
+		}
+	})
+}
+
+// newVibrationAnalyzer creates the analyzer for the movement samples of one session.
+func (bc *bleCollector) newVibrationAnalyzer() *vibrationAnalyzer {
+	for _, s := range sensorTagServices {
+		if s.name == "movement" {
+			var period = time.Duration(bc.period(s)) * 10 * time.Millisecond
+			return newVibrationAnalyzer(bc.vibration.Window, bc.vibration.Hop, float64(time.Second)/float64(period), bc.vibration.Bands)
+		}
+	}
+	return nil
+}
+
+// publishVibration adds the acceleration of a movement notification to the
+// analyzer and publishes the vibration features once a window is full.
+func (bc *bleCollector) publishVibration(va *vibrationAnalyzer, address string, sensorID uint32, samples []sample, at time.Time) {
+	var vs = make(map[string]float64)
+	for _, sm := range samples {
+		vs[sm.Quantity] = sm.Value
+	}
+
+	f, ok := va.Add(vs["acceleration_x"], vs["acceleration_y"], vs["acceleration_z"])
+	if !ok {
+		return
+	}
+
+	bc.publishSamples(address, sensorID, f.samples(va.bandEdges), at)
+}
+
+// publishSamples publishes the valid samples of one notification.
+func (bc *bleCollector) publishSamples(address string, sensorID uint32, samples []sample, at time.Time) {
+	for _, sm := range samples {
+		if math.IsNaN(sm.Value) || math.IsInf(sm.Value, 0) {
+			bc.publishFailure(address, fmt.Errorf("invalid %s %v", sm.Quantity, sm.Value), at)
+			continue
+		}
+
+		bc.devices.Reading(address, at)
+		bc.sseBroker.NewReading(reading{
+			Hostname:    bc.hostnamePlus,
+			SensorID:    sensorID,
+			SensorType:  stSensorTag,
+			Reading:     sm.Value,
+			Quantity:    sm.Quantity,
+			Unit:        sm.Unit,
+			Data:        strconv.FormatFloat(sm.Value, 'f', -1, 64),
+			MaxAlarm:    bc.vibration.MaxAlarm[sm.Quantity],
+			PublishedAt: at,
+		})
+	}
+}
+
+// enabledSensorTagServices returns the services with the given names, all if none are given.
+func enabledSensorTagServices(names []string) []*sensorTagService {
+	if len(names) == 0 {
+		return sensorTagServices
+	}
+
+	var services []*sensorTagService
+	for _, s := range sensorTagServices {
+		for _, name := range names {
+			if s.name == name {
+				services = append(services, s)
+			}
+		}
+	}
+	return services
+}
+
+// publishFailure reports a failure of a SensorTag as an error event.
+func (bc *bleCollector) publishFailure(address string, err error, at time.Time) {
+	bc.devices.Failure(address, err, at)
+	bc.sseBroker.NewReading(reading{
+		Hostname:    bc.hostnamePlus,
+		SensorID:    sensorIDFromAddress(address),
+		SensorType:  stSensorTag,
+		Event:       "error",
+		Data:        err.Error(),
+		PublishedAt: at,
+	})
+}
+
+// sensorIDFromAddress derives the SensorID of a bluetooth device from the lower
+// four bytes of its address, e.g. 24:71:89:C0:23:80 is 0x89c02380.
+func sensorIDFromAddress(address string) uint32 {
+	b, err := hex.DecodeString(strings.Replace(address, ":", "", -1))
+	if err != nil || len(b) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[len(b)-4:])
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+const fakeTagAddress = "24:71:89:C0:23:80"
+
+func TestSensorIDFromAddress(t *testing.T) {
+	if id := sensorIDFromAddress(fakeTagAddress); id != 0x89c02380 {
+		t.Errorf("got %x", id)
+	}
+}
+
+// collect reads n readings of the quantity from the broker.
+func collect(t *testing.T, ch chan []byte, quantity string, n int) []reading {
+	var rs []reading
+	var timeout = time.After(2 * time.Second)
+	for len(rs) < n {
+		select {
+		case <-timeout:
+			t.Fatalf("got %d readings, want %d", len(rs), n)
+		case b := <-ch:
+			var r reading
+			json.Unmarshal(b, &r)
+			if r.Event == "" && r.Quantity == quantity {
+				rs = append(rs, r)
+			}
+		}
+	}
+
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Reading.(float64) < rs[j].Reading.(float64) })
+	return rs
+}
+
+func newTestBLECollector(backend BLEBackend, broker *SSEBroker) *bleCollector {
+	var cfg = defaultConfig()
+	cfg.Hostname = "test"
+	cfg.BLE.Tags = []string{fakeTagAddress}
+
+	var devices = newDeviceRegistry()
+	var bc = newBLECollector(cfg, []bleAdapter{{id: "hci0", backend: backend}}, broker, devices, newWirelessTelemetry(cfg, broker, devices))
+	bc.minBackoff = 10 * time.Millisecond
+	return bc
+}
+
+func TestBLECollectorPublishesNotifications(t *testing.T) {
+	var backend = newFakeBackend()
+	backend.tags[fakeTagAddress] = &fakeTag{
+		notifications: map[string][][]byte{
+			sensorTagServices[0].data: {{0x00, 0x0f, 0x80, 0x0c}, {0x00, 0x0f, 0xc0, 0x0c}},
+		},
+		interval: time.Millisecond,
+	}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var bc = newTestBLECollector(backend, broker)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bc.Run(ctx)
+
+	var rs = collect(t, ch, "temperature", 2)
+	if rs[0].Reading != 25.0 || rs[1].Reading != 25.5 {
+		t.Errorf("got %v and %v, want 25 and 25.5", rs[0].Reading, rs[1].Reading)
+	}
+	if rs[0].SensorID != 0x89c02380 || rs[0].SensorType != stSensorTag || rs[0].Unit != "°C" {
+		t.Errorf("unexpected reading %+v", rs[0])
+	}
+	if rs[0].PublishedAt.IsZero() {
+		t.Error("reading without timestamp")
+	}
+
+	backend.lock.Lock()
+	var fp = backend.peripherals[0]
+	backend.lock.Unlock()
+	if v := fp.value(sensorTagServices[0].config); len(v) != 1 || v[0] != 0x01 {
+		t.Errorf("temperature not enabled, config %x", v)
+	}
+}
+
+func TestBLECollectorMovementPeriod(t *testing.T) {
+	var temperature, movement = sensorTagServices[0], sensorTagServices[4]
+	var backend = newFakeBackend()
+	backend.tags[fakeTagAddress] = &fakeTag{
+		notifications: map[string][][]byte{temperature.data: nil, movement.data: nil},
+	}
+
+	var bc = newTestBLECollector(backend, NewSSEBroker())
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bc.Run(ctx)
+
+	var fp *fakePeripheral
+	var timeout = time.After(2 * time.Second)
+	for fp == nil || fp.value(movement.config) == nil {
+		select {
+		case <-timeout:
+			t.Fatal("movement not enabled")
+		case <-time.After(time.Millisecond):
+		}
+		backend.lock.Lock()
+		if len(backend.peripherals) > 0 {
+			fp = backend.peripherals[0]
+		}
+		backend.lock.Unlock()
+	}
+
+	// 1 s of the interval, the minimum of 100 ms for the vibration
+	if v := fp.value(temperature.period); len(v) != 1 || v[0] != 100 {
+		t.Errorf("temperature period %x", v)
+	}
+	if v := fp.value(movement.period); len(v) != 1 || v[0] != 10 {
+		t.Errorf("movement period %x", v)
+	}
+	if rate := bc.newVibrationAnalyzer().sampleRate; rate != 10 {
+		t.Errorf("vibration sample rate %v Hz", rate)
+	}
+}
+
+func TestBLECollectorReconnects(t *testing.T) {
+	var backend = newFakeBackend()
+	backend.tags[fakeTagAddress] = &fakeTag{
+		notifications: map[string][][]byte{
+			sensorTagServices[0].data: {{0x00, 0x0f, 0x80, 0x0c}},
+		},
+		interval:   time.Millisecond,
+		disconnect: true,
+	}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var bc = newTestBLECollector(backend, broker)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bc.Run(ctx)
+
+	// every session publishes one reading before the tag drops the connection
+	collect(t, ch, "temperature", 3)
+
+	if n := backend.connectCount(fakeTagAddress); n < 3 {
+		t.Errorf("connected %d times, want at least 3", n)
+	}
+
+	var ds = bc.devices.Devices()
+	if len(ds) != 1 || ds[0].Errors == 0 || ds[0].LastError != errBLEDisconnected.Error() {
+		t.Errorf("disconnects not recorded: %+v", ds)
+	}
+}
+
+func TestBLECollectorUnknownTag(t *testing.T) {
+	var broker = NewSSEBroker()
+	var bc = newTestBLECollector(newFakeBackend(), broker)
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	bc.Run(ctx)
+
+	var ds = bc.devices.Devices()
+	if len(ds) != 1 || ds[0].State != deviceDisconnected || ds[0].Errors == 0 {
+		t.Errorf("missing tag not recorded: %+v", ds)
+	}
+}
+
+func TestBLECollectorTelemetry(t *testing.T) {
+	var backend = newFakeBackend()
+	backend.tags[fakeTagAddress] = &fakeTag{
+		values: map[string][]byte{
+			batteryLevelUUID: {15},
+		},
+		notifications: map[string][][]byte{
+			sensorTagServices[0].data: {{0x00, 0x0f, 0x80, 0x0c}},
+		},
+		interval: time.Millisecond,
+		rssi:     -71,
+	}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var bc = newTestBLECollector(backend, broker)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bc.Run(ctx)
+
+	var rs = collect(t, ch, "battery", 1)
+	if !rs[0].Meta || rs[0].Unit != "%" || rs[0].MinAlarm != 20 || rs[0].Alarm != "true" {
+		t.Errorf("unexpected battery reading %+v", rs[0])
+	}
+
+	var ds = bc.devices.Devices()
+	if len(ds) != 1 || ds[0].RSSI == nil || *ds[0].RSSI != -71 || ds[0].Battery == nil || *ds[0].Battery != 15 {
+		t.Errorf("telemetry not recorded: %+v", ds)
+	}
+}
+
+func TestBLECollectorNextAdapter(t *testing.T) {
+	var far, near = newFakeBackend(), newFakeBackend()
+	near.tags[fakeTagAddress] = &fakeTag{
+		notifications: map[string][][]byte{
+			sensorTagServices[0].data: {{0x00, 0x0f, 0x80, 0x0c}},
+		},
+		interval: time.Millisecond,
+	}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var bc = newTestBLECollector(far, broker)
+	bc.adapters = append(bc.adapters, bleAdapter{id: "hci1", backend: near})
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bc.Run(ctx)
+
+	collect(t, ch, "temperature", 1)
+
+	var ds = bc.devices.Devices()
+	if len(ds) != 1 || ds[0].Address != "hci1" {
+		t.Errorf("not connected through hci1: %+v", ds)
+	}
+}
+
+func TestBLEAdapterPowersOnLater(t *testing.T) {
+	var backend = newFakeBackend()
+	backend.tags[fakeTagAddress] = &fakeTag{
+		notifications: map[string][][]byte{
+			sensorTagServices[0].data: {{0x00, 0x0f, 0x80, 0x0c}},
+		},
+		interval: time.Millisecond,
+	}
+
+	// hci0 comes up on the third attempt
+	var attempts = 0
+	var adapter = &adapterBackend{
+		id:    "hci0",
+		state: newComponentState(),
+		open: func() (BLEBackend, error) {
+			if attempts++; attempts < 3 {
+				return nil, errors.New("no such adapter")
+			}
+			return backend, nil
+		},
+	}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var bc = newTestBLECollector(adapter, broker)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bc.Run(ctx)
+
+	collect(t, ch, "temperature", 1)
+	if h := adapter.state.health("ble_adapter", "hci0"); h.Status != componentUp || h.LastError != "no such adapter" {
+		t.Errorf("adapter health %+v", h)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// fakeTag scripts what a fake peripheral does after it is connected.
+type fakeTag struct {
+	values        map[string][]byte   // readable characteristics
+	notifications map[string][][]byte // sent in order after subscribing the characteristic
+	interval      time.Duration       // between two notifications
+	disconnect    bool                // drop the connection after the last notification
+	rssi          int
+}
+
+// fakeBackend is an in-memory BLEBackend for tests, it needs no radio.
+type fakeBackend struct {
+	lock           sync.Mutex
+	tags           map[string]*fakeTag
+	advertisements []bleAdvertisement
+	connects       map[string]int
+	peripherals    []*fakePeripheral
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		tags:     make(map[string]*fakeTag),
+		connects: make(map[string]int),
+	}
+}
+
+func (fb *fakeBackend) Scan(ctx context.Context, found func(bleAdvertisement)) error {
+	fb.lock.Lock()
+	var advs = append([]bleAdvertisement(nil), fb.advertisements...)
+	fb.lock.Unlock()
+
+	for _, a := range advs {
+		found(a)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (fb *fakeBackend) Connect(ctx context.Context, address string) (BLEPeripheral, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	tag, ok := fb.tags[address]
+	if !ok {
+		return nil, errTagNotFound
+	}
+	fb.connects[address]++
+
+	var fp = &fakePeripheral{
+		tag:     tag,
+		written: make(map[string][]byte),
+		done:    make(chan struct{}),
+	}
+	fb.peripherals = append(fb.peripherals, fp)
+	return fp, nil
+}
+
+func (fb *fakeBackend) Close() error {
+	return nil
+}
+
+func (fb *fakeBackend) connectCount(address string) int {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.connects[address]
+}
+
+// fakePeripheral plays the script of its tag.
+type fakePeripheral struct {
+	tag       *fakeTag
+	lock      sync.Mutex
+	written   map[string][]byte
+	done      chan struct{}
+	closeOnce sync.Once
+	sending   sync.WaitGroup
+}
+
+func (fp *fakePeripheral) Discover() ([]string, error) {
+	var uuids []string
+	for uuid := range fp.tag.values {
+		uuids = append(uuids, uuid)
+	}
+	for uuid := range fp.tag.notifications {
+		uuids = append(uuids, uuid)
+	}
+	return uuids, nil
+}
+
+func (fp *fakePeripheral) Read(char string) ([]byte, error) {
+	v, ok := fp.tag.values[char]
+	if !ok {
+		return nil, errors.New("not readable")
+	}
+	return v, nil
+}
+
+func (fp *fakePeripheral) Write(char string, value []byte) error {
+	fp.lock.Lock()
+	fp.written[char] = value
+	fp.lock.Unlock()
+	return nil
+}
+
+func (fp *fakePeripheral) value(char string) []byte {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	return fp.written[char]
+}
+
+func (fp *fakePeripheral) Subscribe(char string, fn func([]byte)) error {
+	var script = fp.tag.notifications[char]
+
+	fp.sending.Add(1)
+	go func() {
+		defer fp.sending.Done()
+		for _, b := range script {
+			select {
+			case <-fp.done:
+				return
+			case <-time.After(fp.tag.interval):
+			}
+			fn(b)
+		}
+
+		if fp.tag.disconnect {
+			fp.Close()
+		}
+	}()
+
+	return nil
+}
+
+func (fp *fakePeripheral) RSSI() (int, error) {
+	return fp.tag.rssi, nil
+}
+
+func (fp *fakePeripheral) Disconnected() <-chan struct{} {
+	return fp.done
+}
+
+func (fp *fakePeripheral) Close() error {
+	fp.closeOnce.Do(func() { close(fp.done) })
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paypal/gatt"
+)
+
+var errGattPoweredOff = errors.New("adapter not powered on")
+
+// gattBackend talks HCI directly with paypal/gatt, without BlueZ.
+// gatt has one set of handlers per device, the backend dispatches
+// the events to the waiting scans and connections.
+type gattBackend struct {
+	d gatt.Device
+
+	lock        sync.Mutex
+	scans       map[int]func(bleAdvertisement) // running scans
+	nextScan    int
+	seen        map[string]gatt.Peripheral // by upper case address
+	connecting  map[string]chan error
+	peripherals map[string]*gattPeripheral // connected peripherals
+}
+
+// newGattBackend opens the adapter, e.g. hci0, and waits until it is powered on.
+func newGattBackend(adapterID string) (*gattBackend, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(adapterID, "hci"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid adapter %q", adapterID)
+	}
+
+	d, err := gatt.NewDevice(gatt.LnxDeviceID(n, false))
+	if err != nil {
+		return nil, err
+	}
+
+	var gb = &gattBackend{
+		d:           d,
+		scans:       make(map[int]func(bleAdvertisement)),
+		seen:        make(map[string]gatt.Peripheral),
+		connecting:  make(map[string]chan error),
+		peripherals: make(map[string]*gattPeripheral),
+	}
+
+	d.Handle(
+		gatt.PeripheralDiscovered(gb.onPeriphDiscovered),
+		gatt.PeripheralConnected(gb.onPeriphConnected),
+		gatt.PeripheralDisconnected(gb.onPeriphDisconnected),
+	)
+
+	var poweredOn = make(chan bool, 1)
+	d.Init(func(d gatt.Device, s gatt.State) {
+		select {
+		case poweredOn <- s == gatt.StatePoweredOn:
+		default:
+		}
+	})
+
+	select {
+	case on := <-poweredOn:
+		if !on {
+			return nil, errGattPoweredOff
+		}
+	case <-time.After(10 * time.Second):
+		return nil, errGattPoweredOff
+	}
+
+	return gb, nil
+}
+
+func (gb *gattBackend) onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+	var address = strings.ToUpper(p.ID())
+
+	var adv = bleAdvertisement{
+		Address:          address,
+		LocalName:        a.LocalName,
+		RSSI:             rssi,
+		ManufacturerData: a.ManufacturerData,
+		ServiceData:      make(map[string][]byte),
+	}
+	for _, sd := range a.ServiceData {
+		adv.ServiceData[normalizeUUID(sd.UUID.String())] = sd.Data
+	}
+
+	gb.lock.Lock()
+	gb.seen[address] = p
+	var scans = make([]func(bleAdvertisement), 0, len(gb.scans))
+	for _, fn := range gb.scans {
+		scans = append(scans, fn)
+	}
+	gb.lock.Unlock()
+
+	for _, fn := range scans {
+		fn(adv)
+	}
+}
+
+func (gb *gattBackend) onPeriphConnected(p gatt.Peripheral, err error) {
+	gb.lock.Lock()
+	ch, ok := gb.connecting[strings.ToUpper(p.ID())]
+	gb.lock.Unlock()
+
+	if !ok {
+		// nobody waits for it any more
+		gb.d.CancelConnection(p)
+		return
+	}
+	ch <- err
+}
+
+func (gb *gattBackend) onPeriphDisconnected(p gatt.Peripheral, err error) {
+	var address = strings.ToUpper(p.ID())
+
+	gb.lock.Lock()
+	gp, ok := gb.peripherals[address]
+	delete(gb.peripherals, address)
+	gb.lock.Unlock()
+
+	if ok {
+		gp.closeOnce.Do(func() { close(gp.done) })
+	}
+}
+
+// Scan reports the advertisements seen until the context is cancelled.
+func (gb *gattBackend) Scan(ctx context.Context, found func(bleAdvertisement)) error {
+	gb.lock.Lock()
+	var id = gb.nextScan
+	gb.nextScan++
+	gb.scans[id] = found
+	if len(gb.scans) == 1 {
+		gb.d.Scan([]gatt.UUID{}, true)
+	}
+	gb.lock.Unlock()
+
+	<-ctx.Done()
+
+	gb.lock.Lock()
+	delete(gb.scans, id)
+	if len(gb.scans) == 0 {
+		gb.d.StopScanning()
+	}
+	gb.lock.Unlock()
+
+	return nil
+}
+
+// Close disconnects the remaining peripherals and stops the HCI device.
+func (gb *gattBackend) Close() error {
+	gb.lock.Lock()
+	var connected []gatt.Peripheral
+	for _, gp := range gb.peripherals {
+		connected = append(connected, gp.p)
+	}
+	gb.lock.Unlock()
+
+	// the disconnect handler takes the lock
+	for _, p := range connected {
+		gb.d.CancelConnection(p)
+	}
+	return gb.d.Stop()
+}
+
+// peripheral returns the peripheral with the address, scanning for it if it was not seen yet.
+func (gb *gattBackend) peripheral(ctx context.Context, address string) (gatt.Peripheral, error) {
+	gb.lock.Lock()
+	p, ok := gb.seen[address]
+	gb.lock.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	var scanCtx, cancel = context.WithTimeout(ctx, bleDiscovery)
+	defer cancel()
+
+	gb.Scan(scanCtx, func(a bleAdvertisement) {
+		if a.Address == address {
+			cancel()
+		}
+	})
+
+	gb.lock.Lock()
+	p, ok = gb.seen[address]
+	gb.lock.Unlock()
+	if !ok {
+		return nil, errTagNotFound
+	}
+
+	return p, nil
+}
+
+func (gb *gattBackend) Connect(ctx context.Context, address string) (BLEPeripheral, error) {
+	address = strings.ToUpper(address)
+
+	p, err := gb.peripheral(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var ch = make(chan error, 1)
+	gb.lock.Lock()
+	gb.connecting[address] = ch
+	gb.lock.Unlock()
+
+	defer func() {
+		gb.lock.Lock()
+		delete(gb.connecting, address)
+		gb.lock.Unlock()
+	}()
+
+	gb.d.Connect(p)
+
+	select {
+	case <-ctx.Done():
+		gb.d.CancelConnection(p)
+		return nil, ctx.Err()
+	case <-time.After(bleDiscovery):
+		gb.d.CancelConnection(p)
+		return nil, errors.New("connect timed out")
+	case err = <-ch:
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var gp = &gattPeripheral{
+		d:     gb.d,
+		p:     p,
+		chars: make(map[string]*gatt.Characteristic),
+		done:  make(chan struct{}),
+	}
+
+	gb.lock.Lock()
+	gb.peripherals[address] = gp
+	gb.lock.Unlock()
+
+	if err := p.SetMTU(500); err != nil {
+		// the default MTU is enough for the SensorTag
+		log.Printf("Failed to set MTU of %s, err: %s\n", address, err)
+	}
+
+	return gp, nil
+}
+
+// gattPeripheral is a peripheral connected with paypal/gatt.
+type gattPeripheral struct {
+	d     gatt.Device
+	p     gatt.Peripheral
+	chars map[string]*gatt.Characteristic // by normalised UUID, filled by Discover
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Discover finds all services, characteristics and their descriptors,
+// the descriptors are needed to enable notifications.
+func (gp *gattPeripheral) Discover() ([]string, error) {
+	ss, err := gp.p.DiscoverServices(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover services: %s", err)
+	}
+
+	var uuids []string
+	for _, s := range ss {
+		cs, err := gp.p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover characteristics: %s", err)
+		}
+
+		for _, c := range cs {
+			if _, err := gp.p.DiscoverDescriptors(nil, c); err != nil {
+				return nil, fmt.Errorf("failed to discover descriptors: %s", err)
+			}
+
+			var uuid = normalizeUUID(c.UUID().String())
+			gp.chars[uuid] = c
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	return uuids, nil
+}
+
+func (gp *gattPeripheral) char(uuid string) (*gatt.Characteristic, error) {
+	c, ok := gp.chars[normalizeUUID(uuid)]
+	if !ok {
+		return nil, fmt.Errorf("characteristic %s not discovered", uuid)
+	}
+	return c, nil
+}
+
+func (gp *gattPeripheral) Read(uuid string) ([]byte, error) {
+	c, err := gp.char(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return gp.p.ReadCharacteristic(c)
+}
+
+func (gp *gattPeripheral) Write(uuid string, value []byte) error {
+	c, err := gp.char(uuid)
+	if err != nil {
+		return err
+	}
+	return gp.p.WriteCharacteristic(c, value, false)
+}
+
+// Subscribe writes the client characteristic configuration (2902) through gatt.
+func (gp *gattPeripheral) Subscribe(uuid string, fn func([]byte)) error {
+	c, err := gp.char(uuid)
+	if err != nil {
+		return err
+	}
+
+	return gp.p.SetNotifyValue(c, func(c *gatt.Characteristic, b []byte, err error) {
+		if err == nil {
+			fn(b)
+		}
+	})
+}
+
+func (gp *gattPeripheral) RSSI() (int, error) {
+	return gp.p.ReadRSSI(), nil
+}
+
+func (gp *gattPeripheral) Disconnected() <-chan struct{} {
+	return gp.done
+}
+
+func (gp *gattPeripheral) Close() error {
+	gp.d.CancelConnection(gp.p)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dirkjabl/bricker"
+	"github.com/dirkjabl/bricker/device"
+	"github.com/dirkjabl/bricker/device/bricklet/ambientlight"
+	"github.com/dirkjabl/bricker/device/bricklet/analogin"
+	"github.com/dirkjabl/bricker/device/bricklet/barometer"
+	"github.com/dirkjabl/bricker/device/bricklet/humidity"
+	"github.com/dirkjabl/bricker/device/bricklet/industrialdual020ma"
+	"github.com/dirkjabl/bricker/device/bricklet/moisture"
+	"github.com/dirkjabl/bricker/device/bricklet/temperature"
+)
+
+// errNoResult is returned by a driver when the bricklet did not answer.
+var errNoResult = errors.New("no result")
+
+// errUnexpectedResult is returned by a driver when a callback delivers something it does not know.
+var errUnexpectedResult = errors.New("unexpected result")
+
+// sample is one typed value read from a bricklet.
+type sample struct {
+	Quantity string
+	Unit     string
+	Value    float64
+}
+
+// brickletDriver knows how to read one type of bricklet.
+//
+// Values are not polled, the bricklet sends them with its period callback.
+// The callback only fires when the value changed since the last period.
+type brickletDriver struct {
+	name string
+
+	// setPeriod sets the callback period of the bricklet in ms, 0 turns the callback off.
+	setPeriod func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error
+
+	// callback creates the subscriber for the value callback of the bricklet.
+	callback func(uid uint32, handler func(device.Resulter, error)) *device.Device
+
+	// decode turns a result of the callback into samples.
+	decode func(r device.Resulter) ([]sample, error)
+}
+
+// brickletDrivers maps the device identifier to the driver of the bricklet.
+var brickletDrivers = make(map[uint16]*brickletDriver)
+
+// registerBrickletDriver makes a bricklet type known to hardwareidentify.
+func registerBrickletDriver(deviceIdentifier uint16, d *brickletDriver) {
+	if _, ok := brickletDrivers[deviceIdentifier]; ok {
+		panic(fmt.Sprintf("bricklet driver %d registered twice", deviceIdentifier))
+	}
+	brickletDrivers[deviceIdentifier] = d
+}
+
+// periodFuture adapts the boolean result of a bricker future to an error.
+func periodFuture(ok bool) error {
+	if !ok {
+		return errNoResult
+	}
+	return nil
+}
+
+func init() {
+	registerBrickletDriver(blTemperature, &brickletDriver{
+		name: "temperature",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			return periodFuture(temperature.SetTemperatureCallbackPeriodFuture(brick, connectorName, uid, &device.Period{Value: period}))
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return temperature.TemperatureCallback("temperature", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			t, ok := r.(*temperature.Temperature)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			return []sample{{Quantity: "temperature", Unit: "°C", Value: t.Float64()}}, nil
+		},
+	})
+}
+
+func init() {
+	registerBrickletDriver(blMoisture, &brickletDriver{
+		name: "moisture",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			return periodFuture(moisture.SetMoistureCallbackPeriodFuture(brick, connectorName, uid, &device.Period{Value: period}))
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return moisture.MoistureCallback("moisture", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			m, ok := r.(*moisture.Moisture)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			// raw value of the sensor between 0 (dry) and 4095 (wet)
+			return []sample{{Quantity: "moisture", Unit: "", Value: float64(m.Value)}}, nil
+		},
+	})
+}
+
+func init() {
+	registerBrickletDriver(blHumidity, &brickletDriver{
+		name: "humidity",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			return periodFuture(humidity.SetHumidityCallbackPeriodFuture(brick, connectorName, uid, &device.Period{Value: period}))
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return humidity.HumidityCallback("humidity", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			h, ok := r.(*humidity.Humidity)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			return []sample{{Quantity: "humidity", Unit: "%RH", Value: h.Float64()}}, nil
+		},
+	})
+}
+
+func init() {
+	registerBrickletDriver(blBarometer, &brickletDriver{
+		name: "barometer",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			return periodFuture(barometer.SetAirPressureCallbackPeriodFuture(brick, connectorName, uid, &device.Period{Value: period}))
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return barometer.AirPressureCallback("barometer", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			p, ok := r.(*barometer.AirPressure)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			return []sample{{Quantity: "pressure", Unit: "hPa", Value: p.Float64()}}, nil
+		},
+	})
+}
+
+func init() {
+	registerBrickletDriver(blAmbientLight, &brickletDriver{
+		name: "ambient light",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			return periodFuture(ambientlight.SetIlluminanceCallbackPeriodFuture(brick, connectorName, uid, &device.Period{Value: period}))
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return ambientlight.IlluminanceCallback("ambientlight", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			l, ok := r.(*ambientlight.Illuminance)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			return []sample{{Quantity: "illuminance", Unit: "lx", Value: l.Float64()}}, nil
+		},
+	})
+}
+
+func init() {
+	registerBrickletDriver(blAnalogIn, &brickletDriver{
+		name: "analog in",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			return periodFuture(analogin.SetVoltageCallbackPeriodFuture(brick, connectorName, uid, &device.Period{Value: period}))
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return analogin.VoltageCallback("analogin", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			v, ok := r.(*analogin.Voltage)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			return []sample{{Quantity: "voltage", Unit: "V", Value: v.Float64()}}, nil
+		},
+	})
+}
+
+// The industrial dual 0-20mA bricklet reads the 4-20mA vibration transmitters,
+// each of its two channels is one transmitter and has its own callback period.
+func init() {
+	registerBrickletDriver(blIndustrialDual020mA, &brickletDriver{
+		name: "industrial dual 0-20mA",
+		setPeriod: func(brick *bricker.Bricker, connectorName string, uid uint32, period uint32) error {
+			for channel := uint8(0); channel < 2; channel++ {
+				var sp = &industrialdual020ma.SensorPeriod{Sensor: channel, Value: period}
+				if err := periodFuture(industrialdual020ma.SetCurrentCallbackPeriodFuture(brick, connectorName, uid, sp)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		callback: func(uid uint32, handler func(device.Resulter, error)) *device.Device {
+			return industrialdual020ma.CurrentCallback("industrialdual020ma", uid, handler)
+		},
+		decode: func(r device.Resulter) ([]sample, error) {
+			c, ok := r.(*industrialdual020ma.SensorCurrent)
+			if !ok {
+				return nil, errUnexpectedResult
+			}
+			return []sample{{
+				Quantity: fmt.Sprintf("current_%d", c.Sensor),
+				Unit:     "mA",
+				Value:    c.Float64(),
+			}}, nil
+		},
+	})
+}
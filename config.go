@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// config is read from a JSON file, the command line flags override it.
+type config struct {
+	Listen   string `json:"listen"`   // address of the web server, of /metrics and the health checks of the agent
+	Hostname string `json:"hostname"` // stamped on the readings of the local collectors
+	Console  bool   `json:"console"`  // print the read values on the console, too
+
+	Brickd          []string       `json:"brickd"`           // addresses of the brickd daemons to read, none disables the collector
+	BrickletPeriod  int            `json:"bricklet_period"`  // callback period of the bricklets in ms, more than 0
+	BrickletPeriods map[string]int `json:"bricklet_periods"` // callback period in ms by bricklet uid, e.g. {"dXj": 100}
+
+	BLE       bleConfig            `json:"ble"`
+	Agent     agentConfig          `json:"agent"`
+	MQTT      mqttConfig           `json:"mqtt"`
+	Modbus    []modbusDeviceConfig `json:"modbus"`
+	OPCUA     []opcuaServerConfig  `json:"opcua"`
+	Vibration vibrationConfig      `json:"vibration"`
+	Notify    notifyConfig         `json:"notify"`
+
+	Escalation escalationConfig `json:"escalation"`
+
+	Assets      map[string][]string `json:"assets"`      // sensors by asset, e.g. {"gearbox-1": ["2311", "edge1/3405691582"]}
+	Maintenance []maintenanceWindow `json:"maintenance"` // scheduled maintenance windows of the assets, more are added by the API
+	History     int                 `json:"history"`     // readings kept per stream for the history API
+	Annotations string              `json:"annotations"` // file the annotations are kept in, none keeps them in memory only
+	Prometheus  prometheusConfig    `json:"prometheus"`
+}
+
+// prometheusConfig configures the push of the readings to Prometheus.
+type prometheusConfig struct {
+	RemoteWrite string `json:"remote_write"` // URL of the remote write endpoint, none disables the push
+	Interval    int    `json:"interval"`     // between two pushes in ms
+	Username    string `json:"username"`     // basic auth, if set
+	Password    string `json:"password"`
+}
+
+// vibrationConfig configures the analysis of the SensorTag movement data.
+type vibrationConfig struct {
+	Period   int                `json:"period"`    // movement notification period of the SensorTags in ms, at least 100 (10 Hz, up to 5 Hz)
+	Window   int                `json:"window"`    // samples per window, a power of 2
+	Hop      int                `json:"hop"`       // samples between two windows, 0 is a full window
+	Bands    []float64          `json:"bands"`     // band edges in Hz, default four bands up to the Nyquist frequency
+	MaxAlarm map[string]float64 `json:"max_alarm"` // upper alarm limit by feature, e.g. {"vibration_rms": 0.3}
+}
+
+// bleConfig configures the collector of the TI SensorTags.
+type bleConfig struct {
+	Backend  string   `json:"backend"`  // bluetooth stack, bluez (default) or gatt
+	Adapter  string   `json:"adapter"`  // bluetooth adapter, e.g. hci0
+	Adapters []string `json:"adapters"` // several bluetooth adapters, e.g. [hci0, hci1], instead of Adapter
+	Tags     []string `json:"tags"`     // addresses of the SensorTags, none disables the collector
+	Beacons  []string `json:"beacons"`  // addresses of the sensors only read from their advertisements, e.g. RuuviTags
+	Interval int      `json:"interval"` // notification period of the SensorTags and minimum time between two beacon readings in ms
+	Services []string `json:"services"` // sensors to switch on: temperature, humidity, pressure, optics, movement; all if empty
+
+	Telemetry         int     `json:"telemetry"`           // seconds between two RSSI, battery and uptime readings of a SensorTag
+	LowBattery        float64 `json:"low_battery"`         // alarm limit of the battery level in %
+	LowBatteryVoltage float64 `json:"low_battery_voltage"` // alarm limit of the battery voltage of beacons in V
+}
+
+// adapters returns the bluetooth adapters to use.
+func (c bleConfig) adapters() []string {
+	if len(c.Adapters) > 0 {
+		return c.Adapters
+	}
+	return []string{c.Adapter}
+}
+
+// mqttConfig configures the MQTT bridge.
+type mqttConfig struct {
+	Broker        string             `json:"broker"` // e.g. tcp://localhost:1883, none disables the bridge
+	ClientID      string             `json:"client_id"`
+	Username      string             `json:"username"`
+	Password      string             `json:"password"`
+	QoS           byte               `json:"qos"`
+	Subscriptions []mqttSubscription `json:"subscriptions"`
+	Publish       string             `json:"publish"` // topic prefix of the published readings, none publishes nothing
+	Alarms        string             `json:"alarms"`  // topic prefix of the alarm transitions, none publishes nothing
+}
+
+// notifyConfig configures the notifications of the alarm transitions.
+type notifyConfig struct {
+	Channels  []notifyChannel `json:"channels"`   // none disables the notifications
+	Routes    []notifyRoute   `json:"routes"`     // channels by asset, without routes all alarms go to all channels
+	RateLimit int             `json:"rate_limit"` // ms between two notifications of a stream on a channel, the latest is sent after it
+	Retries   int             `json:"retries"`    // attempts to deliver a notification
+}
+
+// escalationConfig configures the escalation of unacknowledged alarms to
+// the channels of the notifier.
+type escalationConfig struct {
+	Policies  []escalationPolicy `json:"policies"`  // tiers by asset, none disables the escalation
+	Schedules []onCallSchedule   `json:"schedules"` // on-call schedules the tiers refer to
+}
+
+// agentConfig configures the agent subcommand, which forwards the readings to a central server.
+type agentConfig struct {
+	Server   string `json:"server"`    // base URL of the central server, e.g. http://predictive.plant
+	Queue    string `json:"queue"`     // directory of the store-and-forward queue
+	Batch    int    `json:"batch"`     // readings per batch
+	Flush    int    `json:"flush"`     // ms after which the pending readings are queued even if the batch is not full
+	MaxQueue int    `json:"max_queue"` // batches kept on disk, the oldest are dropped beyond; 0 keeps all
+}
+
+func defaultConfig() *config {
+	var hostname, _ = os.Hostname()
+
+	return &config{
+		Listen:   "0.0.0.0:80",
+		Hostname: hostname,
+
+		History:     10000,
+		Annotations: "annotations.jsonl",
+
+		BrickletPeriod: 1000,
+
+		BLE: bleConfig{
+			Adapter:  "hci0",
+			Interval: 1000,
+
+			Telemetry:         60,
+			LowBattery:        20,
+			LowBatteryVoltage: 2.5,
+		},
+		Vibration: vibrationConfig{
+			Period: 100,
+			Window: 64,
+			Hop:    32,
+		},
+		Prometheus: prometheusConfig{
+			Interval: 10000,
+		},
+		Notify: notifyConfig{
+			RateLimit: 300000,
+			Retries:   5,
+		},
+		Agent: agentConfig{
+			Queue:    "queue",
+			Batch:    500,
+			Flush:    5000,
+			MaxQueue: 10000,
+		},
+	}
+}
+
+// loadConfig reads the configuration file at path on top of the defaults.
+func loadConfig(path string) (*config, error) {
+	var cfg = defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	fc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(fc, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// parseConfig loads the configuration named on the command line and applies the flags.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	var path = fs.String("config", "", "path of the JSON configuration file")
+	var listen = fs.String("listen", "", "address of the web server (the metrics of the agent), default is 0.0.0.0:80")
+	var hostname = fs.String("hostname", "", "hostname stamped on the readings, default is the host name")
+	var brickd = fs.String("brickd", "", "comma separated addresses of the brickd daemons, e.g. localhost:4223")
+	var console = fs.Bool("console", false, "show the read values on the console, too")
+	var tags = fs.String("tags", "", "comma separated addresses of the SensorTags, e.g. 24:71:89:C0:23:80")
+	var beacons = fs.String("beacons", "", "comma separated addresses of the sensors read from their advertisements")
+	var server = fs.String("server", "", "agent: base URL of the central server, e.g. http://predictive.plant")
+	var queue = fs.String("queue", "", "agent: directory of the store-and-forward queue")
+	var mqttBroker = fs.String("mqtt", "", "address of the MQTT broker, e.g. tcp://localhost:1883")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		return nil, err
+	}
+
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if *hostname != "" {
+		cfg.Hostname = *hostname
+	}
+	if *brickd != "" {
+		cfg.Brickd = strings.Split(*brickd, ",")
+	}
+	if *tags != "" {
+		cfg.BLE.Tags = strings.Split(*tags, ",")
+	}
+	if *beacons != "" {
+		cfg.BLE.Beacons = strings.Split(*beacons, ",")
+	}
+	if *console {
+		cfg.Console = true
+	}
+	if *server != "" {
+		cfg.Agent.Server = *server
+	}
+	if *queue != "" {
+		cfg.Agent.Queue = *queue
+	}
+	if *mqttBroker != "" {
+		cfg.MQTT.Broker = *mqttBroker
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	deviceConnected    = "connected"
+	deviceDisconnected = "disconnected"
+	deviceFailing      = "failing" // connected, but the last read failed
+)
+
+// deviceHealth is what the device registry knows about one sensor device.
+type deviceHealth struct {
+	ID        string    `json:"id"`   // uid of a bricklet, address of a bluetooth device
+	Kind      string    `json:"kind"` // e.g. bricklet, sensortag
+	Hostname  string    `json:"hostname"`
+	Address   string    `json:"address"` // where the device is reached, e.g. the brickd or adapter
+	SensorID  uint32    `json:"sensor_id"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"` // last change of State
+	Readings  uint64    `json:"readings"`
+	Errors    uint64    `json:"errors"`
+	LastError string    `json:"last_error"`
+
+	LastReadingAt time.Time `json:"last_reading_at"`
+	LastErrorAt   time.Time `json:"last_error_at"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Uptime        float64   `json:"uptime"` // seconds since ConnectedAt, 0 if not connected
+
+	// wireless sensors only
+	RSSI        *int      `json:"rssi,omitempty"` // dBm
+	RSSIAt      time.Time `json:"rssi_at"`
+	Battery     *float64  `json:"battery,omitempty"`
+	BatteryUnit string    `json:"battery_unit,omitempty"` // % or V
+}
+
+// deviceRegistry tracks the state and the read errors of all sensor devices.
+type deviceRegistry struct {
+	devices map[string]*deviceHealth
+	locker  *sync.RWMutex
+}
+
+func newDeviceRegistry() *deviceRegistry {
+	return &deviceRegistry{
+		devices: make(map[string]*deviceHealth),
+		locker:  &sync.RWMutex{},
+	}
+}
+
+// device returns the entry for id, creating it if needed. The caller holds the lock.
+func (dr *deviceRegistry) device(id string) *deviceHealth {
+	d, ok := dr.devices[id]
+	if !ok {
+		d = &deviceHealth{ID: id, State: deviceDisconnected, Since: time.Now()}
+		dr.devices[id] = d
+	}
+	return d
+}
+
+func (d *deviceHealth) setState(state string, at time.Time) {
+	if d.State != state {
+		d.State = state
+		d.Since = at
+	}
+}
+
+// Connected records that a device showed up.
+func (dr *deviceRegistry) Connected(id, kind, hostname, address string, sensorID uint32) {
+	dr.locker.Lock()
+	defer dr.locker.Unlock()
+
+	var d = dr.device(id)
+	d.Kind = kind
+	d.Hostname = hostname
+	d.Address = address
+	d.SensorID = sensorID
+	d.ConnectedAt = time.Now()
+	d.setState(deviceConnected, d.ConnectedAt)
+}
+
+// Disconnected records that a device is gone.
+func (dr *deviceRegistry) Disconnected(id string) {
+	dr.locker.Lock()
+	defer dr.locker.Unlock()
+
+	dr.device(id).setState(deviceDisconnected, time.Now())
+}
+
+// Reading records a successful read of a device. A disconnected device stays
+// disconnected until it is connected again, e.g. for a reading still on its
+// way when the connection was lost.
+func (dr *deviceRegistry) Reading(id string, at time.Time) {
+	dr.locker.Lock()
+	defer dr.locker.Unlock()
+
+	var d = dr.device(id)
+	d.Readings++
+	d.LastReadingAt = at
+	if d.State != deviceDisconnected {
+		d.setState(deviceConnected, at)
+	}
+}
+
+// Failure records a failed read of a device, a disconnected device stays
+// disconnected.
+func (dr *deviceRegistry) Failure(id string, err error, at time.Time) {
+	dr.locker.Lock()
+	defer dr.locker.Unlock()
+
+	var d = dr.device(id)
+	d.Errors++
+	d.LastError = err.Error()
+	d.LastErrorAt = at
+	if d.State != deviceDisconnected {
+		d.setState(deviceFailing, at)
+	}
+}
+
+// RSSI records the signal strength a wireless device is received with.
+func (dr *deviceRegistry) RSSI(id string, rssi int, at time.Time) {
+	dr.locker.Lock()
+	defer dr.locker.Unlock()
+
+	var d = dr.device(id)
+	d.RSSI = &rssi
+	d.RSSIAt = at
+}
+
+// Battery records the battery level (%) or voltage (V) of a wireless device.
+// The voltage of a device that reports a level, too, is not recorded.
+func (dr *deviceRegistry) Battery(id string, level float64, unit string) {
+	dr.locker.Lock()
+	defer dr.locker.Unlock()
+
+	var d = dr.device(id)
+	if unit != "%" && d.BatteryUnit == "%" {
+		return
+	}
+	d.Battery = &level
+	d.BatteryUnit = unit
+}
+
+// Devices returns a copy of all entries, sorted by id.
+func (dr *deviceRegistry) Devices() []deviceHealth {
+	dr.locker.RLock()
+	defer dr.locker.RUnlock()
+
+	var now = time.Now()
+	var ds = make([]deviceHealth, 0, len(dr.devices))
+	for _, d := range dr.devices {
+		var c = *d
+		if c.State != deviceDisconnected && !c.ConnectedAt.IsZero() {
+			c.Uptime = now.Sub(c.ConnectedAt).Seconds()
+		}
+		ds = append(ds, c)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].ID < ds[j].ID })
+
+	return ds
+}
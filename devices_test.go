@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceRegistryStates(t *testing.T) {
+	var tests = []struct {
+		name   string
+		events []string // connected, disconnected, reading or failure
+		state  string
+	}{
+		{"never connected", nil, deviceDisconnected},
+		{"connected", []string{"connected"}, deviceConnected},
+		{"reading", []string{"connected", "reading"}, deviceConnected},
+		{"failing", []string{"connected", "failure"}, deviceFailing},
+		{"recovered", []string{"connected", "failure", "reading"}, deviceConnected},
+		{"disconnected", []string{"connected", "disconnected"}, deviceDisconnected},
+		{"reading after disconnect", []string{"connected", "disconnected", "reading"}, deviceDisconnected},
+		{"failure after disconnect", []string{"connected", "failure", "disconnected", "failure"}, deviceDisconnected},
+		{"reading before connect", []string{"reading"}, deviceDisconnected},
+		{"reconnected", []string{"connected", "disconnected", "connected", "reading"}, deviceConnected},
+	}
+
+	for _, tt := range tests {
+		var dr = newDeviceRegistry()
+		var readings, failures uint64
+		for _, event := range append([]string{"disconnected"}, tt.events...) {
+			var at = time.Now()
+			switch event {
+			case "connected":
+				dr.Connected("dXj", "bricklet", "edge1", "localhost:4223", 1)
+			case "disconnected":
+				dr.Disconnected("dXj")
+			case "reading":
+				dr.Reading("dXj", at)
+				readings++
+			case "failure":
+				dr.Failure("dXj", errors.New("timeout"), at)
+				failures++
+			}
+		}
+
+		var ds = dr.Devices()
+		if len(ds) != 1 || ds[0].State != tt.state {
+			t.Errorf("%s: got devices %+v, want state %s", tt.name, ds, tt.state)
+			continue
+		}
+		// counted in any state
+		if ds[0].Readings != readings || ds[0].Errors != failures {
+			t.Errorf("%s: got %d readings and %d errors", tt.name, ds[0].Readings, ds[0].Errors)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// escalationCheck is how often the open alarms are checked for the next tier.
+const escalationCheck = 15 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// escalationPolicy notifies tier after tier while an alarm of an asset is
+// neither acknowledged nor cleared, in the order of their After. The asset *
+// matches all alarms without a policy of their own.
+type escalationPolicy struct {
+	Asset string           `json:"asset"`
+	Tiers []escalationTier `json:"tiers"`
+}
+
+// escalationTier is notified After minutes without acknowledgement.
+type escalationTier struct {
+	After    int      `json:"after"`    // minutes since the alarm, 0 notifies at once
+	Channels []string `json:"channels"` // channels of the notifier
+	Schedule string   `json:"schedule"` // the channels on call in this schedule, too
+}
+
+// onCallSchedule names who is on call when, by shifts.
+type onCallSchedule struct {
+	Name     string        `json:"name"`
+	Timezone string        `json:"timezone"` // of the shifts, e.g. Europe/Berlin, UTC if empty
+	Shifts   []onCallShift `json:"shifts"`
+}
+
+// onCallShift is a recurring shift, e.g. the night shift from 22:00 to 06:00.
+// A shift ending before it starts ends on the next day, it belongs to the
+// day it starts on.
+type onCallShift struct {
+	Days     []string `json:"days"`     // mon, tue, .., sun; all if empty
+	Start    string   `json:"start"`    // 15:04
+	End      string   `json:"end"`      // 15:04, the same as Start for 24 hours
+	Channels []string `json:"channels"` // of the people on call, e.g. their mail or pager
+}
+
+// shift is a parsed onCallShift.
+type shift struct {
+	days       map[time.Weekday]bool // all if empty
+	start, end int                   // minutes since midnight
+	channels   []string
+}
+
+func parseShift(s onCallShift) (shift, error) {
+	var sh = shift{days: make(map[time.Weekday]bool), channels: s.Channels}
+	for _, d := range s.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return sh, fmt.Errorf("unknown day %q", d)
+		}
+		sh.days[wd] = true
+	}
+
+	var err error
+	if sh.start, err = parseClock(s.Start); err != nil {
+		return sh, err
+	}
+	if sh.end, err = parseClock(s.End); err != nil {
+		return sh, err
+	}
+	return sh, nil
+}
+
+// parseClock parses a time of day as minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (sh shift) on(d time.Weekday) bool {
+	return len(sh.days) == 0 || sh.days[d]
+}
+
+// covers reports whether the shift covers t, in the time zone of the schedule.
+func (sh shift) covers(t time.Time) bool {
+	var minutes = t.Hour()*60 + t.Minute()
+	if sh.start < sh.end {
+		return sh.on(t.Weekday()) && minutes >= sh.start && minutes < sh.end
+	}
+	// over midnight, started today or yesterday
+	var yesterday = (t.Weekday() + 6) % 7
+	return sh.on(t.Weekday()) && minutes >= sh.start || sh.on(yesterday) && minutes < sh.end
+}
+
+// schedule is a parsed onCallSchedule.
+type schedule struct {
+	location *time.Location
+	shifts   []shift
+}
+
+func parseSchedule(s onCallSchedule) (*schedule, error) {
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %s: %s", s.Name, err)
+	}
+
+	var sc = &schedule{location: location}
+	for _, c := range s.Shifts {
+		sh, err := parseShift(c)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %s", s.Name, err)
+		}
+		sc.shifts = append(sc.shifts, sh)
+	}
+	return sc, nil
+}
+
+// OnCall returns the channels on call at t.
+func (sc *schedule) OnCall(t time.Time) []string {
+	t = t.In(sc.location)
+
+	var channels []string
+	for _, sh := range sc.shifts {
+		if sh.covers(t) {
+			channels = append(channels, sh.channels...)
+		}
+	}
+	return channels
+}
+
+// escalation is an alarm on its way through the tiers.
+type escalation struct {
+	r         reading
+	policy    *escalationPolicy
+	raisedAt  time.Time       // the tiers count from, restarted by maintenance
+	tiers     int             // notified so far
+	escalated map[string]bool // notified channels
+}
+
+// escalator escalates the alarm events of the alarm tracker until they are
+// acknowledged or cleared. The channels of an escalated alarm are told when
+// it clears. An alarm is not escalated while its asset is in maintenance,
+// its tiers count from the end of the maintenance.
+type escalator struct {
+	notifier    *notifier
+	maintenance *maintenanceSchedule
+	policies    map[string]*escalationPolicy // by asset
+	schedules   map[string]*schedule         // by name
+
+	lock sync.Mutex
+	open map[string]*escalation // by stream
+}
+
+func newEscalator(cfg *config, nt *notifier, maintenance *maintenanceSchedule) (*escalator, error) {
+	var es = &escalator{
+		notifier:    nt,
+		maintenance: maintenance,
+		policies:    make(map[string]*escalationPolicy),
+		schedules:   make(map[string]*schedule),
+		open:        make(map[string]*escalation),
+	}
+
+	for _, s := range cfg.Escalation.Schedules {
+		sc, err := parseSchedule(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, sh := range s.Shifts {
+			if err = es.checkChannels(sh.Channels); err != nil {
+				return nil, fmt.Errorf("schedule %s: %s", s.Name, err)
+			}
+		}
+		es.schedules[s.Name] = sc
+	}
+
+	for i := range cfg.Escalation.Policies {
+		// sorted, the configuration is left as it is
+		var p = cfg.Escalation.Policies[i]
+		p.Tiers = append([]escalationTier(nil), p.Tiers...)
+		sort.SliceStable(p.Tiers, func(i, j int) bool { return p.Tiers[i].After < p.Tiers[j].After })
+
+		for _, tier := range p.Tiers {
+			if err := es.checkChannels(tier.Channels); err != nil {
+				return nil, fmt.Errorf("policy %s: %s", p.Asset, err)
+			}
+			if _, ok := es.schedules[tier.Schedule]; tier.Schedule != "" && !ok {
+				return nil, fmt.Errorf("policy %s: unknown schedule %s", p.Asset, tier.Schedule)
+			}
+		}
+		es.policies[p.Asset] = &p
+	}
+	return es, nil
+}
+
+func (es *escalator) checkChannels(channels []string) error {
+	for _, name := range channels {
+		if _, ok := es.notifier.targets[name]; !ok {
+			return fmt.Errorf("unknown channel %s", name)
+		}
+	}
+	return nil
+}
+
+// policy returns the policy of an asset, nil if it has none.
+func (es *escalator) policy(asset string) *escalationPolicy {
+	if p, ok := es.policies[asset]; ok {
+		return p
+	}
+	return es.policies["*"]
+}
+
+// Observe is registered as observer of the broker, after the alarm tracker.
+func (es *escalator) Observe(r reading) {
+	switch r.Event {
+	case "alarm":
+		var p = es.policy(r.Asset)
+		if p == nil {
+			return
+		}
+		es.lock.Lock()
+		es.open[r.stream()] = &escalation{
+			r:         r,
+			policy:    p,
+			raisedAt:  time.Now(),
+			escalated: make(map[string]bool),
+		}
+		es.lock.Unlock()
+		// the first tier at once
+		es.Check(time.Now())
+
+	case "alarm_acknowledged":
+		es.lock.Lock()
+		delete(es.open, r.stream())
+		es.lock.Unlock()
+
+	case "alarm_cleared":
+		es.lock.Lock()
+		var e, ok = es.open[r.stream()]
+		delete(es.open, r.stream())
+		es.lock.Unlock()
+
+		if ok {
+			for name := range e.escalated {
+				es.notifier.Notify(name, r)
+			}
+		}
+	}
+}
+
+// Check notifies the tiers that are due at now.
+func (es *escalator) Check(now time.Time) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	for _, e := range es.open {
+		if es.maintenance.Active(e.r.Asset, now) {
+			// rather than every overdue tier at once when it ends
+			e.raisedAt = now
+			continue
+		}
+		for e.tiers < len(e.policy.Tiers) {
+			var tier = e.policy.Tiers[e.tiers]
+			if now.Sub(e.raisedAt) < time.Duration(tier.After)*time.Minute {
+				break
+			}
+			e.tiers++
+
+			var channels = tier.Channels
+			if sc, ok := es.schedules[tier.Schedule]; ok {
+				channels = append(channels[:len(channels):len(channels)], sc.OnCall(now)...)
+			}
+
+			var r = e.r
+			if e.tiers > 1 {
+				r.Event = "alarm_escalated"
+			}
+			for _, name := range channels {
+				if !e.escalated[name] {
+					e.escalated[name] = true
+					es.notifier.Notify(name, r)
+				}
+			}
+		}
+	}
+}
+
+// Run checks the open alarms until the context is cancelled.
+func (es *escalator) Run(ctx context.Context) {
+	var ticker = time.NewTicker(escalationCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			es.Check(now)
+		}
+	}
+}
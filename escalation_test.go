@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShiftCovers(t *testing.T) {
+	night, err := parseShift(onCallShift{Days: []string{"Fri"}, Start: "22:00", End: "06:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2019, 6, 7, 23, 0, 0, 0, time.UTC), true},  // friday night
+		{time.Date(2019, 6, 8, 5, 59, 0, 0, time.UTC), true},  // saturday morning, still the friday shift
+		{time.Date(2019, 6, 8, 6, 0, 0, 0, time.UTC), false},  // over
+		{time.Date(2019, 6, 7, 5, 0, 0, 0, time.UTC), false},  // friday morning, the thursday shift
+		{time.Date(2019, 6, 8, 23, 0, 0, 0, time.UTC), false}, // saturday night
+	}
+	for _, c := range cases {
+		if got := night.covers(c.at); got != c.want {
+			t.Errorf("covers(%s) = %v, want %v", c.at.Format("Mon 15:04"), got, c.want)
+		}
+	}
+
+	if _, err = parseShift(onCallShift{Days: []string{"someday"}, Start: "08:00", End: "16:00"}); err == nil {
+		t.Error("unknown day accepted")
+	}
+	if _, err = parseShift(onCallShift{Start: "8 am", End: "16:00"}); err == nil {
+		t.Error("invalid time of day accepted")
+	}
+}
+
+func TestScheduleOnCall(t *testing.T) {
+	sc, err := parseSchedule(onCallSchedule{
+		Name:     "maintenance",
+		Timezone: "Europe/Berlin",
+		Shifts: []onCallShift{
+			{Start: "06:00", End: "18:00", Channels: []string{"day"}},
+			{Start: "18:00", End: "06:00", Channels: []string{"night"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 17:00 in Berlin in summer
+	if got := sc.OnCall(time.Date(2019, 6, 7, 15, 0, 0, 0, time.UTC)); len(got) != 1 || got[0] != "day" {
+		t.Errorf("on call at 17:00: %v", got)
+	}
+	// 19:00 in Berlin
+	if got := sc.OnCall(time.Date(2019, 6, 7, 17, 0, 0, 0, time.UTC)); len(got) != 1 || got[0] != "night" {
+		t.Errorf("on call at 19:00: %v", got)
+	}
+
+	if _, err = parseSchedule(onCallSchedule{Name: "x", Timezone: "Nowhere/Else"}); err == nil {
+		t.Error("unknown time zone accepted")
+	}
+}
+
+func TestEscalator(t *testing.T) {
+	var posted = make(chan string, 10)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var n reading
+		json.Unmarshal(body, &n)
+		posted <- strings.TrimPrefix(r.URL.Path, "/") + " " + n.Event
+	}))
+	defer srv.Close()
+
+	var cfg = defaultConfig()
+	cfg.Notify.RateLimit = 0 // the clearing right after the alarm
+	for _, name := range []string{"operator", "lead", "day", "night", "manager"} {
+		cfg.Notify.Channels = append(cfg.Notify.Channels, notifyChannel{Name: name, Type: "webhook", URL: srv.URL + "/" + name})
+	}
+	cfg.Escalation.Schedules = []onCallSchedule{{
+		Name: "maintenance",
+		Shifts: []onCallShift{
+			{Start: "06:00", End: "18:00", Channels: []string{"day"}},
+			{Start: "18:00", End: "06:00", Channels: []string{"night"}},
+		},
+	}}
+	cfg.Escalation.Policies = []escalationPolicy{{
+		Asset: "gearbox-1",
+		// out of order
+		Tiers: []escalationTier{
+			{After: 30, Channels: []string{"manager"}},
+			{After: 0, Channels: []string{"operator"}},
+			{After: 10, Channels: []string{"lead"}, Schedule: "maintenance"},
+		},
+	}}
+	nt, err := newNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := newEscalator(cfg, nt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go nt.Run(ctx)
+
+	var expect = func(want ...string) {
+		t.Helper()
+		var got []string
+		for range want {
+			select {
+			case p := <-posted:
+				got = append(got, p)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("got notifications %v, want %v", got, want)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("got notifications %v, want %v", got, want)
+		}
+	}
+
+	es.Observe(alarmEvent("alarm"))
+	expect("operator alarm")
+
+	// the second tier and the shift on call, once
+	var now = time.Now()
+	es.Check(now.Add(5 * time.Minute))
+	es.Check(now.Add(11 * time.Minute))
+	var night = "night alarm_escalated"
+	if h := now.Add(11 * time.Minute).UTC().Hour(); h >= 6 && h < 18 {
+		night = "day alarm_escalated"
+	}
+	expect("lead alarm_escalated", night)
+
+	es.Observe(alarmEvent("alarm_cleared"))
+	expect("operator alarm_cleared", "lead alarm_cleared", strings.Replace(night, "alarm_escalated", "alarm_cleared", 1))
+
+	// acknowledged in time
+	var other = alarmEvent("alarm")
+	other.SensorID = 8
+	es.Observe(other)
+	expect("operator alarm")
+	other.Event = "alarm_acknowledged"
+	es.Observe(other)
+	es.Check(now.Add(time.Hour))
+	select {
+	case p := <-posted:
+		t.Errorf("acknowledged alarm escalated to %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEscalatorMaintenance(t *testing.T) {
+	var posted = make(chan string, 10)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- strings.TrimPrefix(r.URL.Path, "/")
+	}))
+	defer srv.Close()
+
+	var cfg = defaultConfig()
+	for _, name := range []string{"operator", "lead"} {
+		cfg.Notify.Channels = append(cfg.Notify.Channels, notifyChannel{Name: name, Type: "webhook", URL: srv.URL + "/" + name})
+	}
+	cfg.Escalation.Policies = []escalationPolicy{{
+		Asset: "gearbox-1",
+		Tiers: []escalationTier{
+			{After: 0, Channels: []string{"operator"}},
+			{After: 10, Channels: []string{"lead"}},
+		},
+	}}
+	nt, err := newNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := newMaintenanceSchedule(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, err := newEscalator(cfg, nt, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go nt.Run(ctx)
+
+	var now = time.Now()
+	ms.Add(maintenanceWindow{Asset: "gearbox-1", Start: now.Add(time.Minute), End: now.Add(time.Hour)})
+	es.Observe(alarmEvent("alarm"))
+	select {
+	case p := <-posted:
+		if p != "operator" {
+			t.Errorf("notified %s", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first tier not notified")
+	}
+
+	// in maintenance, and not yet due after it
+	es.Check(now.Add(30 * time.Minute))
+	es.Check(now.Add(59 * time.Minute))
+	es.Check(now.Add(65 * time.Minute))
+	select {
+	case p := <-posted:
+		t.Errorf("escalated to %s right after the maintenance", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	es.Check(now.Add(70 * time.Minute))
+	select {
+	case p := <-posted:
+		if p != "lead" {
+			t.Errorf("escalated to %s", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("not escalated after the maintenance")
+	}
+}
+
+func TestEscalatorConfig(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.Notify.Channels = []notifyChannel{{Name: "hook", Type: "webhook", URL: "http://localhost/"}}
+	nt, err := newNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Escalation.Policies = []escalationPolicy{{Asset: "*", Tiers: []escalationTier{{Channels: []string{"pager"}}}}}
+	if _, err = newEscalator(cfg, nt, nil); err == nil {
+		t.Error("tier with an unknown channel accepted")
+	}
+	cfg.Escalation.Policies = []escalationPolicy{{Asset: "*", Tiers: []escalationTier{{Schedule: "weekend"}}}}
+	if _, err = newEscalator(cfg, nt, nil); err == nil {
+		t.Error("tier with an unknown schedule accepted")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rssiHandoverMargin = 5               // dB a receiver must be better by to take a device over
+	gatewayStale       = 3 * time.Minute // without an RSSI from the chosen gateway another one may take over
+)
+
+// rssiSelector chooses, per device, the receiver that hears it best. The
+// chosen receiver is kept until another one is better by the margin or it
+// went silent, so the choice does not flap between two receivers of about
+// the same strength.
+type rssiSelector struct {
+	margin int
+	stale  time.Duration
+
+	lock    sync.Mutex
+	devices map[string]*rssiChoice
+}
+
+type rssiChoice struct {
+	source string
+	rssi   int
+	at     time.Time
+}
+
+func newRSSISelector(margin int, stale time.Duration) *rssiSelector {
+	return &rssiSelector{
+		margin:  margin,
+		stale:   stale,
+		devices: make(map[string]*rssiChoice),
+	}
+}
+
+// Offer reports the RSSI a source receives the device with and returns
+// whether the source is the chosen one afterwards.
+func (s *rssiSelector) Offer(device, source string, rssi int, at time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var c, ok = s.devices[device]
+	if !ok || c.source == source || at.Sub(c.at) > s.stale || rssi >= c.rssi+s.margin {
+		s.devices[device] = &rssiChoice{source: source, rssi: rssi, at: at}
+		return true
+	}
+	return false
+}
+
+// Chosen returns whether the source is the chosen one for the device.
+// Every source is while no RSSI of the device is known.
+func (s *rssiSelector) Chosen(device, source string, at time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var c, ok = s.devices[device]
+	return !ok || c.source == source || at.Sub(c.at) > s.stale
+}
+
+// gatewaySelector de-duplicates the readings of wireless sensors in range of
+// several gateways, each publishing with its own Hostname. Only the gateway
+// with the best RSSI of a sensor gets its readings through, the others are
+// dropped. Sensors without RSSI readings, e.g. bricklets, are not touched.
+type gatewaySelector struct {
+	rssi *rssiSelector
+}
+
+func newGatewaySelector() *gatewaySelector {
+	return &gatewaySelector{rssi: newRSSISelector(rssiHandoverMargin, gatewayStale)}
+}
+
+// Accept is registered as filter of the broker. The clocks of the gateways
+// may differ, so the time of arrival counts.
+func (gs *gatewaySelector) Accept(r *reading) bool {
+	var device = strconv.FormatUint(uint64(r.SensorID), 16)
+	var now = time.Now()
+
+	if rssi, ok := r.Reading.(float64); ok && r.Meta && r.Quantity == "rssi" {
+		return gs.rssi.Offer(device, r.Hostname, int(rssi), now)
+	}
+	return gs.rssi.Chosen(device, r.Hostname, now)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRSSISelectorHandover(t *testing.T) {
+	var s = newRSSISelector(5, time.Minute)
+	var at = time.Now()
+
+	if !s.Offer("tag", "a", -80, at) {
+		t.Error("first receiver not chosen")
+	}
+	if s.Offer("tag", "b", -77, at) {
+		t.Error("handed over within the margin")
+	}
+	if !s.Chosen("tag", "a", at) || s.Chosen("tag", "b", at) {
+		t.Error("wrong receiver chosen")
+	}
+	if !s.Offer("tag", "b", -70, at) {
+		t.Error("not handed over to the better receiver")
+	}
+	if !s.Offer("tag", "a", -90, at.Add(2*time.Minute)) {
+		t.Error("not handed over after the chosen receiver went silent")
+	}
+	if !s.Chosen("other", "c", at) {
+		t.Error("unknown device not accepted")
+	}
+}
+
+func TestGatewaySelectorDropsDuplicates(t *testing.T) {
+	var gs = newGatewaySelector()
+
+	var rssi = func(hostname string, v float64) *reading {
+		return &reading{Hostname: hostname, SensorID: 7, Quantity: "rssi", Reading: v, Meta: true}
+	}
+	var temperature = func(hostname string) *reading {
+		return &reading{Hostname: hostname, SensorID: 7, Quantity: "temperature", Reading: 21.5}
+	}
+
+	if !gs.Accept(temperature("gw1")) || !gs.Accept(temperature("gw2")) {
+		t.Error("readings dropped before any RSSI is known")
+	}
+
+	gs.Accept(rssi("gw1", -85))
+	if !gs.Accept(rssi("gw2", -60)) {
+		t.Error("better gateway not chosen")
+	}
+	if gs.Accept(temperature("gw1")) || !gs.Accept(temperature("gw2")) {
+		t.Error("duplicate of the weaker gateway not dropped")
+	}
+
+	if !gs.Accept(&reading{Hostname: "gw1", SensorID: 8, Quantity: "temperature", Reading: 20.0}) {
+		t.Error("other sensor dropped")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	componentUp   = "up"
+	componentDown = "down"
+)
+
+// componentHealth is the status of one component of the service, as
+// reported by /healthz and /readyz.
+type componentHealth struct {
+	Kind      string    `json:"kind"` // e.g. web, storage, brickd, ble_adapter, mqtt
+	Name      string    `json:"name"` // e.g. the address of the brickd or the id of the adapter
+	Status    string    `json:"status"`
+	Since     time.Time `json:"since"` // last change of Status
+	LastError string    `json:"last_error,omitempty"`
+	Critical  bool      `json:"critical"`         // the service cannot serve without it, e.g. the web server or the storage
+	Wedged    bool      `json:"wedged,omitempty"` // stopped working without noticing, e.g. a session that stopped its heartbeat
+}
+
+// healthReporter is a component, or a group of components, on the health endpoints.
+type healthReporter interface {
+	Health() []componentHealth
+}
+
+// componentState tracks whether a component works. A component starts down
+// until it reports up, e.g. after it connected. The methods accept a nil
+// state, for components built without one in the tests.
+type componentState struct {
+	lock      sync.Mutex
+	up        bool
+	since     time.Time
+	lastError string
+}
+
+func newComponentState() *componentState {
+	return &componentState{since: time.Now()}
+}
+
+// Up records that the component works.
+func (cs *componentState) Up() {
+	if cs == nil {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if !cs.up {
+		cs.up = true
+		cs.since = time.Now()
+	}
+}
+
+// Down records that the component failed.
+func (cs *componentState) Down(err error) {
+	if cs == nil {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.up {
+		cs.up = false
+		cs.since = time.Now()
+	}
+	if err != nil {
+		cs.lastError = err.Error()
+	}
+}
+
+// health returns the status of the component.
+func (cs *componentState) health(kind, name string) componentHealth {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	var h = componentHealth{
+		Kind:      kind,
+		Name:      name,
+		Status:    componentDown,
+		Since:     cs.since,
+		LastError: cs.lastError,
+	}
+	if cs.up {
+		h.Status = componentUp
+	}
+	return h
+}
+
+// healthChecks collects the status of all components. The service is ready
+// when its critical components are up, a sensor or a PLC that is offline
+// does not take the dashboard and the ingest down. It is healthy unless a
+// component is wedged, a restart may help then, while it does not bring an
+// offline device back.
+type healthChecks struct {
+	lock      sync.Mutex
+	reporters []healthReporter
+}
+
+func newHealthChecks() *healthChecks {
+	return &healthChecks{}
+}
+
+// Add adds a component to the checks.
+func (hc *healthChecks) Add(r healthReporter) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	hc.reporters = append(hc.reporters, r)
+}
+
+// Components returns the status of all components.
+func (hc *healthChecks) Components() []componentHealth {
+	hc.lock.Lock()
+	var reporters = hc.reporters
+	hc.lock.Unlock()
+
+	var cs = []componentHealth{}
+	for _, r := range reporters {
+		cs = append(cs, r.Health()...)
+	}
+	return cs
+}
+
+// Ready reports whether the critical components are up.
+func (hc *healthChecks) Ready(cs []componentHealth) bool {
+	for _, c := range cs {
+		if c.Critical && c.Status != componentUp {
+			return false
+		}
+	}
+	return true
+}
+
+// Healthy reports whether no component is wedged.
+func (hc *healthChecks) Healthy(cs []componentHealth) bool {
+	for _, c := range cs {
+		if c.Wedged {
+			return false
+		}
+	}
+	return true
+}
+
+// healthFunc is a healthReporter from a function.
+type healthFunc func() []componentHealth
+
+func (fn healthFunc) Health() []componentHealth {
+	return fn()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHealthChecks(t *testing.T) {
+	var hc = newHealthChecks()
+
+	var storage, adapter = newComponentState(), newComponentState()
+	var wedged = false
+	hc.Add(healthFunc(func() []componentHealth {
+		var s = storage.health("storage", "queue")
+		s.Critical = true
+		var a = adapter.health("ble_adapter", "hci0")
+		a.Wedged = wedged
+		return []componentHealth{s, a}
+	}))
+
+	storage.Up()
+	adapter.Up()
+	if cs := hc.Components(); !hc.Ready(cs) || !hc.Healthy(cs) || len(cs) != 2 {
+		t.Errorf("not ready or healthy: %+v", cs)
+	}
+
+	// an offline device neither takes the service out of the load balancer nor restarts it
+	adapter.Down(errors.New("scan failed"))
+	var cs = hc.Components()
+	if !hc.Ready(cs) || !hc.Healthy(cs) {
+		t.Errorf("a device down: ready %v, healthy %v", hc.Ready(cs), hc.Healthy(cs))
+	}
+	if cs[1].Status != componentDown || cs[1].LastError != "scan failed" {
+		t.Errorf("unexpected adapter %+v", cs[1])
+	}
+
+	storage.Down(errors.New("connection refused"))
+	if cs = hc.Components(); hc.Ready(cs) || !hc.Healthy(cs) {
+		t.Errorf("the storage down: ready %v, healthy %v", hc.Ready(cs), hc.Healthy(cs))
+	}
+
+	wedged = true
+	if cs = hc.Components(); hc.Healthy(cs) {
+		t.Errorf("healthy with a wedged component: %+v", cs)
+	}
+
+	storage.Up()
+	wedged = false
+	if cs = hc.Components(); !hc.Ready(cs) || !hc.Healthy(cs) {
+		t.Errorf("not recovered: %+v", cs)
+	}
+}
+
+func TestComponentStateNil(t *testing.T) {
+	// as the adapters of the tests
+	var cs *componentState
+	cs.Up()
+	cs.Down(errors.New("ignored"))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historyStore keeps the last readings of every stream in memory, for the
+// history API.
+type historyStore struct {
+	keep int // readings per stream, up to twice as many until they are trimmed
+
+	lock     sync.Mutex
+	readings map[string][]reading // by stream
+}
+
+func newHistoryStore(cfg *config) *historyStore {
+	var hs = &historyStore{
+		keep:     cfg.History,
+		readings: make(map[string][]reading),
+	}
+	if hs.keep <= 0 {
+		hs.keep = 1
+	}
+	return hs
+}
+
+// Observe is registered as observer of the broker.
+func (hs *historyStore) Observe(r reading) {
+	if r.Event != "" {
+		return
+	}
+	var stream = r.stream()
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	var rs = append(hs.readings[stream], r)
+	if len(rs) >= 2*hs.keep {
+		// copied once in a while rather than on every reading
+		rs = append([]reading(nil), rs[len(rs)-hs.keep:]...)
+	}
+	hs.readings[stream] = rs
+}
+
+// Between returns the readings of an asset or a stream from from to to, by
+// the time they were published. An empty asset and stream return all
+// streams, a zero bound is open.
+func (hs *historyStore) Between(asset, stream string, from, to time.Time) []reading {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	var found = []reading{}
+	for s, rs := range hs.readings {
+		if stream != "" && s != stream {
+			continue
+		}
+		for _, r := range rs {
+			if asset != "" && r.Asset != asset {
+				continue
+			}
+			if (from.IsZero() || !r.PublishedAt.Before(from)) && (to.IsZero() || !r.PublishedAt.After(to)) {
+				found = append(found, r)
+			}
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].PublishedAt.Before(found[j].PublishedAt) })
+	return found
+}
+
+// parseTimeRange parses the from and to parameters of the history API, as
+// RFC 3339 times. Empty ones are open.
+func parseTimeRange(from, to string) (time.Time, time.Time, error) {
+	var f, t time.Time
+	var err error
+	if from != "" {
+		if f, err = time.Parse(time.RFC3339, from); err != nil {
+			return f, t, fmt.Errorf("invalid from %q", from)
+		}
+	}
+	if to != "" {
+		if t, err = time.Parse(time.RFC3339, to); err != nil {
+			return f, t, fmt.Errorf("invalid to %q", to)
+		}
+	}
+	return f, t, nil
+}
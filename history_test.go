@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryStore(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.History = 3
+	var hs = newHistoryStore(cfg)
+
+	var start = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		var at = start.Add(time.Duration(i) * time.Minute)
+		hs.Observe(reading{Hostname: "edge1", SensorID: 1, Quantity: "temperature", Asset: "gearbox-1", PublishedAt: at})
+		hs.Observe(reading{Hostname: "edge1", SensorID: 2, Quantity: "temperature", Asset: "press", PublishedAt: at})
+	}
+	hs.Observe(reading{Hostname: "edge1", SensorID: 1, Quantity: "temperature", Event: "alarm", PublishedAt: start})
+
+	var rs = hs.Between("", "edge1/1/temperature", time.Time{}, time.Time{})
+	if len(rs) < 3 || len(rs) >= 6 || !rs[len(rs)-1].PublishedAt.Equal(start.Add(9*time.Minute)) {
+		t.Errorf("kept %d readings, the last at %s", len(rs), rs[len(rs)-1].PublishedAt)
+	}
+	for _, r := range rs {
+		if r.Event != "" {
+			t.Error("kept an event")
+		}
+	}
+
+	rs = hs.Between("press", "", start.Add(8*time.Minute), start.Add(9*time.Minute))
+	if len(rs) != 2 || rs[0].SensorID != 2 || rs[0].PublishedAt.After(rs[1].PublishedAt) {
+		t.Errorf("got readings %v", rs)
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	from, to, err := parseTimeRange("2019-06-01T00:00:00Z", "")
+	if err != nil || !from.Equal(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)) || !to.IsZero() {
+		t.Errorf("got %s, %s, %v", from, to, err)
+	}
+	if _, _, err = parseTimeRange("", "yesterday"); err == nil {
+		t.Error("invalid to accepted")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errNoWindow is returned for the end of an unknown maintenance window.
+var errNoWindow = errors.New("no such maintenance window")
+
+// maintenanceWindow is a time an asset is deliberately stopped or serviced.
+// A scheduled window has an end, an ad hoc one may be open until it is ended.
+type maintenanceWindow struct {
+	ID     int       `json:"id"`
+	Asset  string    `json:"asset"`
+	Start  time.Time `json:"start"` // now if zero
+	End    time.Time `json:"end"`   // zero while an ad hoc window is open
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+	Active bool      `json:"active"` // at the time of the listing
+}
+
+// covers reports whether the window covers t.
+func (w maintenanceWindow) covers(t time.Time) bool {
+	return !t.Before(w.Start) && (w.End.IsZero() || t.Before(w.End))
+}
+
+// maintenanceSchedule knows the maintenance windows of the assets. The
+// readings of an asset in maintenance are marked, they raise no alarms and
+// are left out of the history the predictions are calculated from. The
+// methods accept a nil schedule, for components built without one in the
+// tests.
+type maintenanceSchedule struct {
+	lock    sync.Mutex
+	windows []*maintenanceWindow
+	nextID  int
+}
+
+func newMaintenanceSchedule(cfg *config) (*maintenanceSchedule, error) {
+	var ms = &maintenanceSchedule{nextID: 1}
+	for _, w := range cfg.Maintenance {
+		if w.Start.IsZero() || w.End.IsZero() {
+			return nil, fmt.Errorf("maintenance of %s: a scheduled window needs a start and an end", w.Asset)
+		}
+		if _, err := ms.Add(w); err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// Add schedules a window, it starts now if it has no start.
+func (ms *maintenanceSchedule) Add(w maintenanceWindow) (maintenanceWindow, error) {
+	if w.Asset == "" {
+		return w, errors.New("maintenance needs an asset")
+	}
+	if w.Start.IsZero() {
+		w.Start = time.Now()
+	}
+	if !w.End.IsZero() && !w.End.After(w.Start) {
+		return w, fmt.Errorf("maintenance of %s ends before it starts", w.Asset)
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	w.ID = ms.nextID
+	w.Active = false
+	ms.nextID++
+	ms.windows = append(ms.windows, &w)
+	return w, nil
+}
+
+// End ends a window now, a window yet to start is cancelled.
+func (ms *maintenanceSchedule) End(id int) error {
+	var now = time.Now()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for i, w := range ms.windows {
+		if w.ID != id {
+			continue
+		}
+		if now.Before(w.Start) {
+			ms.windows = append(ms.windows[:i], ms.windows[i+1:]...)
+		} else if w.End.IsZero() || now.Before(w.End) {
+			w.End = now
+		}
+		return nil
+	}
+	return errNoWindow
+}
+
+// Windows returns the active and the upcoming windows by start, the ended
+// ones are forgotten.
+func (ms *maintenanceSchedule) Windows() []maintenanceWindow {
+	var now = time.Now()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	var kept = ms.windows[:0]
+	var ws = []maintenanceWindow{}
+	for _, w := range ms.windows {
+		if !w.End.IsZero() && !now.Before(w.End) {
+			continue
+		}
+		kept = append(kept, w)
+
+		var c = *w
+		c.Active = w.covers(now)
+		ws = append(ws, c)
+	}
+	ms.windows = kept
+
+	sort.Slice(ws, func(i, j int) bool { return ws[i].Start.Before(ws[j].Start) })
+	return ws
+}
+
+// Active reports whether an asset is in maintenance at t.
+func (ms *maintenanceSchedule) Active(asset string, t time.Time) bool {
+	if ms == nil || asset == "" {
+		return false
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for _, w := range ms.windows {
+		if w.Asset == asset && w.covers(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark is registered as filter of the broker after the asset registry, it
+// marks the readings of the assets in maintenance.
+func (ms *maintenanceSchedule) Mark(r *reading) bool {
+	if r.Event != "" || r.Maintenance {
+		return true
+	}
+	var at = r.PublishedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	r.Maintenance = ms.Active(r.Asset, at)
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceSchedule(t *testing.T) {
+	var now = time.Now()
+	var cfg = defaultConfig()
+	cfg.Maintenance = []maintenanceWindow{
+		{Asset: "press", Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Reason: "bearing"},
+	}
+	ms, err := newMaintenanceSchedule(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adhoc, err := ms.Add(maintenanceWindow{Asset: "gearbox-1", Reason: "oil change", By: "anna"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ms.Active("gearbox-1", time.Now()) || ms.Active("press", time.Now()) {
+		t.Error("wrong assets in maintenance")
+	}
+	if !ms.Active("press", now.Add(90*time.Minute)) || ms.Active("press", now.Add(2*time.Hour)) {
+		t.Error("scheduled window not covered")
+	}
+
+	var ws = ms.Windows()
+	if len(ws) != 2 || ws[0].ID != adhoc.ID || !ws[0].Active || ws[1].Active {
+		t.Errorf("got windows %v", ws)
+	}
+
+	if err = ms.End(adhoc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Active("gearbox-1", time.Now()) {
+		t.Error("ended window still active")
+	}
+	// the upcoming window is cancelled
+	if err = ms.End(ws[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if ws = ms.Windows(); len(ws) != 0 {
+		t.Errorf("got windows %v", ws)
+	}
+	if err = ms.End(42); err != errNoWindow {
+		t.Errorf("ended an unknown window: %v", err)
+	}
+
+	if _, err = ms.Add(maintenanceWindow{Asset: "press", Start: now, End: now.Add(-time.Minute)}); err == nil {
+		t.Error("window ending before its start accepted")
+	}
+	cfg.Maintenance = []maintenanceWindow{{Asset: "press", Start: now}}
+	if _, err = newMaintenanceSchedule(cfg); err == nil {
+		t.Error("scheduled window without end accepted")
+	}
+}
+
+func TestMaintenanceSuppressesAlarms(t *testing.T) {
+	ms, err := newMaintenanceSchedule(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var broker = NewSSEBroker()
+	broker.AddFilter(newAssetRegistry(map[string][]string{"gearbox-1": {"1"}}).Tag)
+	broker.AddFilter(ms.Mark)
+	var alarms = newAlarmTracker(broker)
+	broker.AddObserver(alarms.Observe)
+	var sm = newSensorMetrics()
+	broker.AddObserver(sm.Observe)
+
+	var events []string
+	broker.AddObserver(func(r reading) {
+		if r.Event != "" {
+			events = append(events, r.Event)
+		}
+	})
+
+	var r = reading{Hostname: "edge1", SensorID: 1, Quantity: "temperature", Reading: 1000.0, Data: "1000", MaxAlarm: 1500}
+	broker.NewReading(r)
+
+	w, err := ms.Add(maintenanceWindow{Asset: "gearbox-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Reading, r.Data = 200.0, "200"
+	r.MinAlarm = 800
+	broker.NewReading(r)
+	if len(events) != 0 {
+		t.Errorf("alarm events in maintenance: %v", events)
+	}
+	if h := sm.last[r.stream()].history; len(h) != 1 {
+		t.Errorf("maintenance reading in the history %v", h)
+	}
+
+	ms.End(w.ID)
+	broker.NewReading(r)
+	if len(events) != 1 || events[0] != "alarm" {
+		t.Errorf("got events %v after the maintenance", events)
+	}
+}
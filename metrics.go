@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics of the service, scraped from /metrics.
+var (
+	sseMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "predictive_sse_messages_total",
+		Help: "Messages sent to the SSE clients.",
+	})
+	sseDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "predictive_sse_messages_dropped_total",
+		Help: "Messages an SSE client did not take in time.",
+	})
+	ingestReadings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "predictive_ingest_readings_total",
+		Help: "Readings received from outside, by endpoint.",
+	}, []string{"endpoint"})
+	ingestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "predictive_ingest_errors_total",
+		Help: "Requests or messages that could not be read, by endpoint.",
+	}, []string{"endpoint"})
+	alarmsRaised = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "predictive_alarms_total",
+		Help: "Alarms raised, by host, sensor and quantity.",
+	}, []string{"host", "sensor", "quantity"})
+	collectorReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "predictive_collector_reconnects_total",
+		Help: "Lost or failed connections of the collectors, by collector.",
+	}, []string{"collector"})
+	notificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "predictive_notifications_total",
+		Help: "Alarm notifications, by channel and result: sent, failed, limited or dropped.",
+	}, []string{"channel", "result"})
+	storageWrites = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "predictive_storage_write_seconds",
+		Help: "Latency of the writes to storage, by storage.",
+	}, []string{"storage"})
+)
+
+// registerBrokerMetrics exposes the number of connected SSE clients.
+func registerBrokerMetrics(broker *SSEBroker) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "predictive_sse_clients",
+		Help: "Connected SSE clients.",
+	}, func() float64 {
+		return float64(broker.Clients())
+	}))
+}
+
+// registerAlarmMetrics exposes the number of streams in alarm.
+func registerAlarmMetrics(alarms *alarmTracker) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "predictive_alarms_active",
+		Help: "Streams outside of their alarm band.",
+	}, func() float64 {
+		return float64(alarms.Active())
+	}))
+}
+
+// sensorValue returns the numeric value of a reading.
+func sensorValue(r reading) (float64, bool) {
+	if v, ok := r.Reading.(float64); ok {
+		return v, true
+	}
+	// e.g. the simulator sends the value as data only
+	v, err := strconv.ParseFloat(r.Data, 64)
+	return v, err == nil
+}
+
+// appendHistory appends a value to the history of a stream, it keeps as
+// many values as the prediction needs, one more than its window.
+func appendHistory(history []float64, v float64) []float64 {
+	history = append(history, v)
+	if len(history) > predictWindow+1 {
+		history = history[len(history)-predictWindow-1:]
+	}
+	return history
+}
+
+// sensorLabels name a stream in the sensor metrics.
+var sensorLabels = []string{"host", "sensor", "type", "asset", "quantity"}
+
+var (
+	sensorValueDesc = prometheus.NewDesc("predictive_sensor_value",
+		"Last value of a sensor.", append(sensorLabels, "unit"), nil)
+	sensorAgeDesc = prometheus.NewDesc("predictive_sensor_age_seconds",
+		"Seconds since the last value of a sensor.", sensorLabels, nil)
+	sensorCEDesc = prometheus.NewDesc("predictive_sensor_ce",
+		"Moving average of a sensor, CE on the dashboard.", sensorLabels, nil)
+	sensorTEDesc = prometheus.NewDesc("predictive_sensor_te",
+		"Target of a sensor, TE on the dashboard.", sensorLabels, nil)
+	sensorMREDesc = prometheus.NewDesc("predictive_sensor_mre",
+		"MRE of a sensor on the dashboard.", sensorLabels, nil)
+	sensorTUFDesc = prometheus.NewDesc("predictive_sensor_tuf",
+		"Time until failure of a sensor, TUF on the dashboard.", sensorLabels, nil)
+)
+
+// sensorMetrics keeps the last value of every stream for the scrape, along
+// with the prediction the dashboard shows for it.
+type sensorMetrics struct {
+	lock sync.Mutex
+	last map[string]*sensorSample // by stream
+}
+
+type sensorSample struct {
+	r       reading // with the prediction
+	value   float64
+	at      time.Time // arrival, the clocks of the sources may differ
+	history []float64
+}
+
+func newSensorMetrics() *sensorMetrics {
+	return &sensorMetrics{last: make(map[string]*sensorSample)}
+}
+
+// labels returns the values of the sensorLabels.
+func (s *sensorSample) labels() []string {
+	return []string{
+		s.r.Hostname,
+		strconv.FormatUint(uint64(s.r.SensorID), 10),
+		strconv.FormatUint(uint64(s.r.SensorType), 10),
+		s.r.Asset,
+		s.r.Quantity,
+	}
+}
+
+// Observe is registered as observer of the broker.
+func (sm *sensorMetrics) Observe(r reading) {
+	if r.Event != "" {
+		return
+	}
+	var v, ok = sensorValue(r)
+	if !ok {
+		return
+	}
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	var s, known = sm.last[r.stream()]
+	if !known {
+		s = &sensorSample{}
+		sm.last[r.stream()] = s
+	}
+	s.r, s.value, s.at = r, v, time.Now()
+
+	if !r.Meta {
+		// the readings in maintenance are no baseline
+		if !r.Maintenance {
+			s.history = appendHistory(s.history, v)
+		}
+		predict(&s.r, s.history)
+	}
+}
+
+func (sm *sensorMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sensorValueDesc
+	ch <- sensorAgeDesc
+	ch <- sensorCEDesc
+	ch <- sensorTEDesc
+	ch <- sensorMREDesc
+	ch <- sensorTUFDesc
+}
+
+func (sm *sensorMetrics) Collect(ch chan<- prometheus.Metric) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	var now = time.Now()
+	for _, s := range sm.last {
+		var labels = s.labels()
+		ch <- prometheus.MustNewConstMetric(sensorValueDesc, prometheus.GaugeValue, s.value, append(labels, s.r.Unit)...)
+		ch <- prometheus.MustNewConstMetric(sensorAgeDesc, prometheus.GaugeValue, now.Sub(s.at).Seconds(), labels...)
+
+		if !s.r.Meta {
+			ch <- prometheus.MustNewConstMetric(sensorCEDesc, prometheus.GaugeValue, s.r.CE, labels...)
+			ch <- prometheus.MustNewConstMetric(sensorTEDesc, prometheus.GaugeValue, s.r.TE, labels...)
+			ch <- prometheus.MustNewConstMetric(sensorMREDesc, prometheus.GaugeValue, s.r.MRE, labels...)
+			ch <- prometheus.MustNewConstMetric(sensorTUFDesc, prometheus.GaugeValue, s.r.TUF, labels...)
+		}
+	}
+}
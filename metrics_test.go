@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSensorMetrics(t *testing.T) {
+	var sm = newSensorMetrics()
+	// more values than the window of the prediction
+	for i := 1; i <= 32; i++ {
+		sm.Observe(reading{Hostname: "test", SensorID: 7, SensorType: stModbus, Asset: "press", Quantity: "temperature", Unit: "°C", Reading: float64(i)})
+	}
+	sm.Observe(reading{Hostname: "test", SensorID: 7, Event: "disconnected"})
+	sm.Observe(reading{Hostname: "test", SensorID: 7, Asset: "press", Quantity: "rssi", Data: "-70", Meta: true})
+
+	var want = `
+# HELP predictive_sensor_value Last value of a sensor.
+# TYPE predictive_sensor_value gauge
+predictive_sensor_value{asset="press",host="test",quantity="rssi",sensor="7",type="0",unit=""} -70
+predictive_sensor_value{asset="press",host="test",quantity="temperature",sensor="7",type="44032",unit="°C"} 32
+# HELP predictive_sensor_ce Moving average of a sensor, CE on the dashboard.
+# TYPE predictive_sensor_ce gauge
+predictive_sensor_ce{asset="press",host="test",quantity="temperature",sensor="7",type="44032"} 16.5
+`
+	if err := testutil.CollectAndCompare(sm, strings.NewReader(want), "predictive_sensor_value", "predictive_sensor_ce"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(sm, "predictive_sensor_age_seconds"); n != 2 {
+		t.Errorf("%d ages, want 2", n)
+	}
+}
+
+func TestBrokerCountsMessages(t *testing.T) {
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var sent = testutil.ToFloat64(sseMessages)
+	broker.NewReading(reading{Quantity: "temperature", Reading: 1.0})
+	<-ch
+
+	// the counter follows the send
+	time.Sleep(10 * time.Millisecond)
+	if n := testutil.ToFloat64(sseMessages) - sent; n != 1 {
+		t.Errorf("%v messages counted, want 1", n)
+	}
+	if n := broker.Clients(); n != 1 {
+		t.Errorf("%d clients, want 1", n)
+	}
+}
+
+func TestAlarmMetrics(t *testing.T) {
+	var broker = NewSSEBroker()
+	var alarms = newAlarmTracker(broker)
+	broker.AddObserver(alarms.Observe)
+
+	var raised = testutil.ToFloat64(alarmsRaised.WithLabelValues("metrics", "3", "current"))
+	broker.NewReading(reading{Hostname: "metrics", SensorID: 3, Quantity: "current", Reading: 12.0, MaxAlarm: 10})
+
+	if n := testutil.ToFloat64(alarmsRaised.WithLabelValues("metrics", "3", "current")) - raised; n != 1 {
+		t.Errorf("%v alarms counted, want 1", n)
+	}
+	if n := alarms.Active(); n != 1 {
+		t.Errorf("%d active alarms, want 1", n)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// stModbus is the SensorType of the readings of a Modbus device.
+const stModbus uint16 = 0xac00
+
+const (
+	modbusMinBackoff = time.Second
+	modbusMaxBackoff = time.Minute
+)
+
+// modbusDeviceConfig is a Modbus TCP server, e.g. a PLC, and the registers to poll.
+type modbusDeviceConfig struct {
+	Address   string           `json:"address"`  // host:port, the port is usually 502
+	UnitID    byte             `json:"unit_id"`  // slave id behind a gateway
+	Name      string           `json:"name"`     // the SensorID is derived from it, address/unit_id if empty
+	Interval  int              `json:"interval"` // between two polls in ms
+	Timeout   int              `json:"timeout"`  // of a request in ms
+	Registers []modbusRegister `json:"registers"`
+}
+
+// modbusRegister maps one value of a device. 32 and 64 bit values span
+// several registers starting at Address.
+type modbusRegister struct {
+	Sensor    string  `json:"sensor"` // the SensorID is derived from it, the name of the device if empty
+	Quantity  string  `json:"quantity"`
+	Unit      string  `json:"unit"`
+	Table     string  `json:"table"`      // holding (default) or input
+	Address   uint16  `json:"address"`    // zero based
+	Type      string  `json:"type"`       // uint16 (default), int16, uint32, int32, float32 or float64
+	ByteOrder string  `json:"byte_order"` // ABCD (big endian, default), DCBA, BADC or CDAB
+	Scale     float64 `json:"scale"`      // the value is raw * scale + offset, 0 is 1
+	Offset    float64 `json:"offset"`
+	MinAlarm  float64 `json:"min_alarm"`
+	MaxAlarm  float64 `json:"max_alarm"`
+}
+
+// registers returns how many registers the value spans.
+func (mr *modbusRegister) registers() (uint16, error) {
+	switch mr.Type {
+	case "", "uint16", "int16":
+		return 1, nil
+	case "uint32", "int32", "float32":
+		return 2, nil
+	case "float64":
+		return 4, nil
+	}
+	return 0, fmt.Errorf("unknown type %q", mr.Type)
+}
+
+// validate checks the settings, so polling fails only on the device.
+func (mr *modbusRegister) validate() error {
+	if _, err := mr.registers(); err != nil {
+		return err
+	}
+	if _, err := mr.bigEndian(make([]byte, 2)); err != nil {
+		return err
+	}
+	if mr.Table != "" && mr.Table != "holding" && mr.Table != "input" {
+		return fmt.Errorf("unknown table %q", mr.Table)
+	}
+	return nil
+}
+
+// bigEndian reorders the bytes read from the registers to big endian.
+func (mr *modbusRegister) bigEndian(b []byte) ([]byte, error) {
+	var be = make([]byte, len(b))
+	switch mr.ByteOrder {
+	case "", "ABCD":
+		copy(be, b)
+	case "DCBA":
+		for i := range b {
+			be[i] = b[len(b)-1-i]
+		}
+	case "BADC":
+		// bytes swapped within each register
+		for i := 0; i+1 < len(b); i += 2 {
+			be[i], be[i+1] = b[i+1], b[i]
+		}
+	case "CDAB":
+		// registers in reverse order
+		for i := 0; i+1 < len(b); i += 2 {
+			copy(be[i:i+2], b[len(b)-2-i:len(b)-i])
+		}
+	default:
+		return nil, fmt.Errorf("unknown byte order %q", mr.ByteOrder)
+	}
+	return be, nil
+}
+
+// decode converts the bytes of the registers to the scaled value.
+func (mr *modbusRegister) decode(b []byte) (float64, error) {
+	n, err := mr.registers()
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != int(n)*2 {
+		return 0, fmt.Errorf("%d bytes, want %d", len(b), n*2)
+	}
+
+	if b, err = mr.bigEndian(b); err != nil {
+		return 0, err
+	}
+
+	var raw float64
+	switch mr.Type {
+	case "", "uint16":
+		raw = float64(binary.BigEndian.Uint16(b))
+	case "int16":
+		raw = float64(int16(binary.BigEndian.Uint16(b)))
+	case "uint32":
+		raw = float64(binary.BigEndian.Uint32(b))
+	case "int32":
+		raw = float64(int32(binary.BigEndian.Uint32(b)))
+	case "float32":
+		raw = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case "float64":
+		raw = math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+
+	var scale = mr.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return raw*scale + mr.Offset, nil
+}
+
+// modbusCollector polls Modbus TCP devices, every device on its own.
+type modbusCollector struct {
+	pollers []*modbusPoller
+}
+
+func newModbusCollector(cfg *config, sseBroker *SSEBroker, devices *deviceRegistry) (*modbusCollector, error) {
+	var mc = &modbusCollector{}
+	for _, d := range cfg.Modbus {
+		var id = fmt.Sprintf("%s/%d", d.Address, d.UnitID)
+		for _, mr := range d.Registers {
+			if err := mr.validate(); err != nil {
+				return nil, fmt.Errorf("modbus %s %s: %s", id, mr.Quantity, err)
+			}
+		}
+
+		var name = d.Name
+		if name == "" {
+			name = id
+		}
+
+		var interval = time.Duration(d.Interval) * time.Millisecond
+		if interval <= 0 {
+			interval = time.Second
+		}
+		var timeout = time.Duration(d.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+
+		mc.pollers = append(mc.pollers, &modbusPoller{
+			id:           id,
+			hostnamePlus: cfg.Hostname,
+			sensorID:     sensorIDFromName(name),
+			device:       d,
+			interval:     interval,
+			timeout:      timeout,
+			sseBroker:    sseBroker,
+			devices:      devices,
+			state:        newComponentState(),
+			minBackoff:   modbusMinBackoff,
+			maxBackoff:   modbusMaxBackoff,
+		})
+	}
+	return mc, nil
+}
+
+// Run polls all devices until the context is cancelled.
+func (mc *modbusCollector) Run(ctx context.Context) {
+	var wg = sync.WaitGroup{}
+	for _, p := range mc.pollers {
+		wg.Add(1)
+		go func(p *modbusPoller) {
+			defer wg.Done()
+			p.run(ctx)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Health reports the connection to every device.
+func (mc *modbusCollector) Health() []componentHealth {
+	var hs []componentHealth
+	for _, p := range mc.pollers {
+		hs = append(hs, p.state.health("modbus", p.id))
+	}
+	return hs
+}
+
+// modbusPoller polls the registers of one device.
+type modbusPoller struct {
+	id           string // address/unit
+	hostnamePlus string
+	sensorID     uint32
+	device       modbusDeviceConfig
+	interval     time.Duration
+	timeout      time.Duration
+	sseBroker    *SSEBroker
+	devices      *deviceRegistry
+	state        *componentState
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// run keeps polling the device, reconnecting with an exponential backoff.
+func (mp *modbusPoller) run(ctx context.Context) {
+	var bo = newBackoff(mp.minBackoff, mp.maxBackoff)
+	for {
+		var started = time.Now()
+		var err = mp.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > mp.maxBackoff {
+			bo.Reset()
+		}
+
+		mp.publishFailure(mp.sensorID, err, time.Now())
+		mp.devices.Disconnected(mp.id)
+		mp.state.Down(err)
+
+		collectorReconnects.WithLabelValues("modbus").Inc()
+		log.Printf("Modbus %s: %s, reconnecting in %s\n", mp.id, err, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// session connects the device and polls it until the context is cancelled
+// or the connection fails. An exception of a register is published, the
+// other registers are polled on.
+func (mp *modbusPoller) session(ctx context.Context) error {
+	var handler = modbus.NewTCPClientHandler(mp.device.Address)
+	handler.SlaveId = mp.device.UnitID
+	handler.Timeout = mp.timeout
+	// the connection is kept between the polls
+	handler.IdleTimeout = 0
+
+	if err := handler.Connect(); err != nil {
+		return err
+	}
+	defer handler.Close()
+
+	var client = modbus.NewClient(handler)
+	mp.devices.Connected(mp.id, "modbus", mp.hostnamePlus, mp.device.Address, mp.sensorID)
+	mp.state.Up()
+	log.Println("Modbus", mp.id, "connected")
+
+	var ticker = time.NewTicker(mp.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := mp.poll(client); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// registerSensorID returns the SensorID of a register.
+func (mp *modbusPoller) registerSensorID(mr *modbusRegister) uint32 {
+	if mr.Sensor != "" {
+		return sensorIDFromName(mr.Sensor)
+	}
+	return mp.sensorID
+}
+
+// poll reads all registers once. It returns an error if the connection failed.
+func (mp *modbusPoller) poll(client modbus.Client) error {
+	for i := range mp.device.Registers {
+		var mr = &mp.device.Registers[i]
+		var sensorID = mp.registerSensorID(mr)
+
+		var at = time.Now()
+		b, err := mp.read(client, mr)
+		if _, exception := err.(*modbus.ModbusError); exception {
+			mp.publishFailure(sensorID, fmt.Errorf("%s: %s", mr.Quantity, err), at)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", mr.Quantity, err)
+		}
+
+		v, err := mr.decode(b)
+		if err != nil {
+			mp.publishFailure(sensorID, fmt.Errorf("%s: %s", mr.Quantity, err), at)
+			continue
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			mp.publishFailure(sensorID, fmt.Errorf("invalid %s %v", mr.Quantity, v), at)
+			continue
+		}
+
+		mp.devices.Reading(mp.id, at)
+		mp.sseBroker.NewReading(reading{
+			Hostname:    mp.hostnamePlus,
+			SensorID:    sensorID,
+			SensorType:  stModbus,
+			Reading:     v,
+			Quantity:    mr.Quantity,
+			Unit:        mr.Unit,
+			Data:        strconv.FormatFloat(v, 'f', -1, 64),
+			MinAlarm:    mr.MinAlarm,
+			MaxAlarm:    mr.MaxAlarm,
+			PublishedAt: at,
+		})
+	}
+	return nil
+}
+
+// read reads the registers of a value, the register was validated.
+func (mp *modbusPoller) read(client modbus.Client, mr *modbusRegister) ([]byte, error) {
+	var n, _ = mr.registers()
+	if mr.Table == "input" {
+		return client.ReadInputRegisters(mr.Address, n)
+	}
+	return client.ReadHoldingRegisters(mr.Address, n)
+}
+
+// publishFailure reports a failure of a device or a register as an error event.
+func (mp *modbusPoller) publishFailure(sensorID uint32, err error, at time.Time) {
+	mp.devices.Failure(mp.id, err, at)
+	mp.sseBroker.NewReading(reading{
+		Hostname:    mp.hostnamePlus,
+		SensorID:    sensorID,
+		SensorType:  stModbus,
+		Event:       "error",
+		Data:        err.Error(),
+		PublishedAt: at,
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestModbusDecode(t *testing.T) {
+	var f32 = make([]byte, 4)
+	binary.BigEndian.PutUint32(f32, math.Float32bits(72.5))
+
+	var tests = []struct {
+		register modbusRegister
+		b        []byte
+		want     float64
+	}{
+		{modbusRegister{}, []byte{0x01, 0x02}, 258},
+		{modbusRegister{Type: "int16", Scale: 0.1}, []byte{0xff, 0x38}, -20},
+		{modbusRegister{Type: "uint16", Offset: -40}, []byte{0x00, 0x64}, 60},
+		{modbusRegister{Type: "uint32"}, []byte{0x00, 0x01, 0x00, 0x02}, 65538},
+		{modbusRegister{Type: "int32", ByteOrder: "CDAB"}, []byte{0xff, 0xfe, 0xff, 0xff}, -2},
+		{modbusRegister{Type: "float32"}, f32, 72.5},
+		{modbusRegister{Type: "float32", ByteOrder: "DCBA"}, []byte{f32[3], f32[2], f32[1], f32[0]}, 72.5},
+		{modbusRegister{Type: "float32", ByteOrder: "BADC"}, []byte{f32[1], f32[0], f32[3], f32[2]}, 72.5},
+		{modbusRegister{Type: "float32", ByteOrder: "CDAB"}, []byte{f32[2], f32[3], f32[0], f32[1]}, 72.5},
+	}
+
+	for _, tt := range tests {
+		v, err := tt.register.decode(tt.b)
+		if err != nil || math.Abs(v-tt.want) > 1e-9 {
+			t.Errorf("%+v of %x: got %v, %v, want %v", tt.register, tt.b, v, err, tt.want)
+		}
+	}
+
+	if _, err := (&modbusRegister{Type: "uint32"}).decode([]byte{0x01, 0x02}); err == nil {
+		t.Error("short value decoded")
+	}
+	if err := (&modbusRegister{ByteOrder: "ACBD"}).validate(); err == nil {
+		t.Error("unknown byte order accepted")
+	}
+}
+
+// modbusSimulator is a Modbus TCP server answering reads of its holding registers,
+// other addresses get an illegal data address exception.
+func modbusSimulator(t *testing.T, registers map[uint16]uint16) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					// MBAP header, function, start address and count
+					var req = make([]byte, 12)
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+
+					var start = binary.BigEndian.Uint16(req[8:])
+					var count = binary.BigEndian.Uint16(req[10:])
+					var pdu = []byte{req[7], byte(count * 2)}
+					for a := start; a < start+count; a++ {
+						v, ok := registers[a]
+						if !ok {
+							pdu = []byte{req[7] | 0x80, 0x02}
+							break
+						}
+						pdu = append(pdu, byte(v>>8), byte(v))
+					}
+
+					var resp = append([]byte{}, req[:7]...)
+					binary.BigEndian.PutUint16(resp[4:], uint16(len(pdu)+1))
+					conn.Write(append(resp, pdu...))
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestModbusCollectorPolls(t *testing.T) {
+	var address = modbusSimulator(t, map[uint16]uint16{
+		10: 0x00e1,             // 22.5 °C
+		11: 0x0000, 12: 0x0c80, // 3200 rpm
+	})
+
+	var cfg = defaultConfig()
+	cfg.Hostname = "test"
+	cfg.Modbus = []modbusDeviceConfig{{
+		Address:  address,
+		UnitID:   1,
+		Name:     "gearbox",
+		Interval: 10,
+		Registers: []modbusRegister{
+			{Quantity: "temperature", Unit: "°C", Address: 10, Type: "int16", Scale: 0.1, MaxAlarm: 80},
+			{Sensor: "motor", Quantity: "speed", Unit: "rpm", Address: 11, Type: "uint32"},
+			{Quantity: "current", Unit: "A", Address: 99},
+		},
+	}}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte)
+	broker.AddClient(ch)
+
+	var devices = newDeviceRegistry()
+	mc, err := newModbusCollector(cfg, broker, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go mc.Run(ctx)
+
+	var temperature = collect(t, ch, "temperature", 1)[0]
+	if temperature.Reading != 22.5 || temperature.SensorType != stModbus || temperature.SensorID != sensorIDFromName("gearbox") || temperature.MaxAlarm != 80 {
+		t.Errorf("unexpected reading %+v", temperature)
+	}
+	if speed := collect(t, ch, "speed", 1)[0]; speed.Reading != 3200.0 || speed.SensorID != sensorIDFromName("motor") {
+		t.Errorf("unexpected reading %+v", speed)
+	}
+
+	// the exception of the missing register does not end the session
+	time.Sleep(30 * time.Millisecond)
+	var ds = devices.Devices()
+	if len(ds) != 1 || ds[0].State == deviceDisconnected || ds[0].Errors == 0 {
+		t.Errorf("unexpected device %+v", ds)
+	}
+}
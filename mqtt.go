@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttMinBackoff = time.Second
+	mqttMaxBackoff = time.Minute
+	mqttTimeout    = 10 * time.Second // of connecting and subscribing
+)
+
+// mqttSubscription maps the messages of a topic to readings. The topic names
+// the parts of the reading it carries in braces, e.g. plant/{hostname}/sensor/{sensor},
+// the braces are subscribed as + wildcards.
+type mqttSubscription struct {
+	Topic    string  `json:"topic"`
+	Format   string  `json:"format"`    // value (default): a number or {"value": ..}; reading: as posted to /
+	Quantity string  `json:"quantity"`  // if the topic has no {quantity}
+	Unit     string  `json:"unit"`      // if neither topic nor payload have one
+	MinAlarm float64 `json:"min_alarm"` // if the payload has none
+	MaxAlarm float64 `json:"max_alarm"`
+}
+
+// filter is the topic filter to subscribe.
+func (s *mqttSubscription) filter() string {
+	var levels = strings.Split(s.Topic, "/")
+	for i, level := range levels {
+		if strings.HasPrefix(level, "{") && strings.HasSuffix(level, "}") {
+			levels[i] = "+"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
+// fields returns the values of the placeholders in the topic of a message.
+func (s *mqttSubscription) fields(topic string) map[string]string {
+	var fields = make(map[string]string)
+	var names, values = strings.Split(s.Topic, "/"), strings.Split(topic, "/")
+	for i, name := range names {
+		if i < len(values) && strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+			fields[strings.Trim(name, "{}")] = values[i]
+		}
+	}
+	return fields
+}
+
+// mqttValue is the JSON payload of the value format, all but the value are optional.
+type mqttValue struct {
+	Value     *float64  `json:"value"`
+	Unit      string    `json:"unit"`
+	Quantity  string    `json:"quantity"`
+	Timestamp time.Time `json:"timestamp"`
+	MinAlarm  float64   `json:"min_alarm"`
+	MaxAlarm  float64   `json:"max_alarm"`
+}
+
+// reading maps a message to a reading. Fields missing in topic and payload
+// default to the hostname of the bridge and the settings of the subscription.
+func (s *mqttSubscription) reading(hostname, topic string, payload []byte, at time.Time) (reading, error) {
+	var r reading
+
+	if s.Format == "reading" {
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return r, err
+		}
+	} else {
+		var v mqttValue
+		var text = strings.TrimSpace(string(payload))
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			v.Value = &f
+		} else if err = json.Unmarshal(payload, &v); err != nil {
+			return r, err
+		}
+		if v.Value == nil {
+			return r, errors.New("no value")
+		}
+
+		r = reading{
+			Reading:     *v.Value,
+			Data:        strconv.FormatFloat(*v.Value, 'f', -1, 64),
+			Quantity:    v.Quantity,
+			Unit:        v.Unit,
+			MinAlarm:    v.MinAlarm,
+			MaxAlarm:    v.MaxAlarm,
+			PublishedAt: v.Timestamp,
+		}
+	}
+
+	var fields = s.fields(topic)
+	if h := fields["hostname"]; h != "" {
+		r.Hostname = h
+	}
+	if q := fields["quantity"]; q != "" {
+		r.Quantity = q
+	}
+	if sensor := fields["sensor"]; sensor != "" {
+		r.SensorID = sensorIDFromName(sensor)
+	}
+
+	if r.Hostname == "" {
+		r.Hostname = hostname
+	}
+	if r.Quantity == "" {
+		r.Quantity = s.Quantity
+	}
+	if r.Unit == "" {
+		r.Unit = s.Unit
+	}
+	if r.MinAlarm == 0 && r.MaxAlarm == 0 {
+		r.MinAlarm, r.MaxAlarm = s.MinAlarm, s.MaxAlarm
+	}
+	if r.PublishedAt.IsZero() {
+		r.PublishedAt = at
+	}
+	return r, nil
+}
+
+// sensorIDFromName derives the SensorID of a sensor named in a topic, a
+// number is taken as it is, e.g. 42 or 0x2a, others are hashed.
+func sensorIDFromName(name string) uint32 {
+	if id, err := strconv.ParseUint(name, 0, 32); err == nil {
+		return uint32(id)
+	}
+	var h = fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+// mqttBridge feeds the messages of the subscribed topics into the broker, the
+// same way as readings posted to /. It optionally publishes the readings,
+// enriched with their alarm flag, and the alarm transitions back. Subscribing
+// the topics it publishes to would loop.
+type mqttBridge struct {
+	hostnamePlus string
+	cfg          mqttConfig
+	sseBroker    *SSEBroker
+	devices      *deviceRegistry
+	client       mqtt.Client
+	state        *componentState
+	ctx          context.Context // of Run, ends the retries of the subscriptions
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newMQTTBridge(cfg *config, sseBroker *SSEBroker, devices *deviceRegistry) *mqttBridge {
+	var mb = &mqttBridge{
+		hostnamePlus: cfg.Hostname,
+		cfg:          cfg.MQTT,
+		sseBroker:    sseBroker,
+		devices:      devices,
+		state:        newComponentState(),
+		ctx:          context.Background(),
+		minBackoff:   mqttMinBackoff,
+		maxBackoff:   mqttMaxBackoff,
+	}
+
+	var clientID = cfg.MQTT.ClientID
+	if clientID == "" {
+		clientID = "predictive-" + cfg.Hostname
+	}
+
+	var opts = mqtt.NewClientOptions().
+		AddBroker(cfg.MQTT.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.MQTT.Username).
+		SetPassword(cfg.MQTT.Password).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttMaxBackoff).
+		SetOnConnectHandler(mb.onConnect).
+		SetConnectionLostHandler(mb.onConnectionLost)
+
+	mb.client = mqtt.NewClient(opts)
+	return mb
+}
+
+// Run connects to the MQTT broker until the context is cancelled. A failed
+// first connect is retried with a backoff, later the client reconnects itself.
+func (mb *mqttBridge) Run(ctx context.Context) {
+	mb.ctx = ctx
+	var bo = newBackoff(mb.minBackoff, mb.maxBackoff)
+	for {
+		var token = mb.client.Connect()
+		if !token.WaitTimeout(mqttTimeout) {
+			mb.onConnectionLost(mb.client, errors.New("timeout connecting"))
+		} else if err := token.Error(); err != nil {
+			mb.onConnectionLost(mb.client, err)
+		} else {
+			break
+		}
+
+		log.Printf("MQTT %s: retrying in %s\n", mb.cfg.Broker, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+
+	<-ctx.Done()
+	mb.client.Disconnect(250)
+	mb.devices.Disconnected(mb.cfg.Broker)
+}
+
+// onConnect subscribes the topics, on every reconnect again. The bridge is
+// down until all topics are subscribed, failed subscriptions are retried with
+// a backoff while the connection lasts.
+func (mb *mqttBridge) onConnect(c mqtt.Client) {
+	log.Println("MQTT", mb.cfg.Broker, "connected")
+	mb.devices.Connected(mb.cfg.Broker, "mqtt", mb.hostnamePlus, mb.cfg.Broker, 0)
+
+	var bo = newBackoff(mb.minBackoff, mb.maxBackoff)
+	for {
+		var err = mb.subscribe(c)
+		if err == nil {
+			mb.state.Up()
+			return
+		}
+
+		mb.state.Down(err)
+		mb.devices.Failure(mb.cfg.Broker, err, time.Now())
+		log.Printf("MQTT %s: %s, retrying in %s\n", mb.cfg.Broker, err, bo.Next())
+		// the next connect subscribes again
+		if !bo.Wait(mb.ctx) || !c.IsConnectionOpen() {
+			return
+		}
+	}
+}
+
+// subscribe subscribes all topics, a subscription that is not acknowledged
+// in time failed.
+func (mb *mqttBridge) subscribe(c mqtt.Client) error {
+	for i := range mb.cfg.Subscriptions {
+		var s = &mb.cfg.Subscriptions[i]
+		var token = c.Subscribe(s.filter(), mb.cfg.QoS, func(c mqtt.Client, m mqtt.Message) {
+			mb.message(s, m.Topic(), m.Payload())
+		})
+		if !token.WaitTimeout(mqttTimeout) {
+			return fmt.Errorf("subscribing %s: timeout", s.filter())
+		}
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("subscribing %s: %s", s.filter(), err)
+		}
+	}
+	return nil
+}
+
+func (mb *mqttBridge) onConnectionLost(c mqtt.Client, err error) {
+	log.Println("MQTT", mb.cfg.Broker, err)
+	collectorReconnects.WithLabelValues("mqtt").Inc()
+	mb.state.Down(err)
+	mb.devices.Failure(mb.cfg.Broker, err, time.Now())
+	mb.devices.Disconnected(mb.cfg.Broker)
+}
+
+// Health reports the connection to the MQTT broker.
+func (mb *mqttBridge) Health() []componentHealth {
+	return []componentHealth{mb.state.health("mqtt", mb.cfg.Broker)}
+}
+
+// message publishes the reading of a message.
+func (mb *mqttBridge) message(s *mqttSubscription, topic string, payload []byte) {
+	var at = time.Now()
+	r, err := s.reading(mb.hostnamePlus, topic, payload, at)
+	if err != nil {
+		log.Printf("MQTT %s: %s\n", topic, err)
+		ingestErrors.WithLabelValues("mqtt").Inc()
+		mb.devices.Failure(mb.cfg.Broker, fmt.Errorf("%s: %s", topic, err), at)
+		return
+	}
+
+	ingestReadings.WithLabelValues("mqtt").Inc()
+	mb.devices.Reading(mb.cfg.Broker, at)
+	mb.sseBroker.NewReading(r)
+}
+
+// Observe is registered as observer of the broker, it publishes the readings
+// under Publish and the alarm transitions under Alarms, both as
+// <prefix>/<hostname>/<sensor>/<quantity>. The alarm state is retained.
+func (mb *mqttBridge) Observe(r reading) {
+	if !mb.client.IsConnectionOpen() {
+		return
+	}
+
+	var prefix string
+	var retained bool
+	switch {
+	case r.Event == "" && mb.cfg.Publish != "":
+		prefix = mb.cfg.Publish
+	case (r.Event == "alarm" || r.Event == "alarm_cleared") && mb.cfg.Alarms != "":
+		prefix, retained = mb.cfg.Alarms, true
+	default:
+		return
+	}
+
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	var topic = fmt.Sprintf("%s/%s/%d/%s", prefix, r.Hostname, r.SensorID, r.Quantity)
+	mb.client.Publish(topic, mb.cfg.QoS, retained, payload)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMQTTSubscriptionFilter(t *testing.T) {
+	var s = mqttSubscription{Topic: "plant/{hostname}/sensor/{sensor}"}
+	if f := s.filter(); f != "plant/+/sensor/+" {
+		t.Errorf("got %s", f)
+	}
+}
+
+func TestMQTTPlainValue(t *testing.T) {
+	var s = mqttSubscription{Topic: "plant/{hostname}/sensor/{sensor}", Quantity: "temperature", Unit: "°C", MaxAlarm: 80}
+	var at = time.Now()
+
+	r, err := s.reading("bridge", "plant/press-hall/sensor/42", []byte(" 63.5\n"), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Hostname != "press-hall" || r.SensorID != 42 || r.Quantity != "temperature" || r.Unit != "°C" {
+		t.Errorf("unexpected reading %+v", r)
+	}
+	if r.Reading != 63.5 || r.Data != "63.5" || r.MaxAlarm != 80 || !r.PublishedAt.Equal(at) {
+		t.Errorf("unexpected value %+v", r)
+	}
+}
+
+func TestMQTTJSONValue(t *testing.T) {
+	var s = mqttSubscription{Topic: "plant/line1/{sensor}/{quantity}"}
+
+	r, err := s.reading("bridge", "plant/line1/pump-3/pressure", []byte(`{"value": 2.4, "unit": "bar", "timestamp": "2017-03-01T10:00:00Z"}`), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Hostname != "bridge" || r.SensorID != sensorIDFromName("pump-3") || r.Quantity != "pressure" || r.Unit != "bar" || r.Reading != 2.4 {
+		t.Errorf("unexpected reading %+v", r)
+	}
+	if r.PublishedAt.Year() != 2017 {
+		t.Errorf("timestamp not taken: %s", r.PublishedAt)
+	}
+
+	if _, err = s.reading("bridge", "plant/line1/pump-3/pressure", []byte(`{"unit": "bar"}`), time.Now()); err == nil {
+		t.Error("payload without value accepted")
+	}
+}
+
+func TestMQTTReadingFormat(t *testing.T) {
+	var s = mqttSubscription{Topic: "predictive/in", Format: "reading"}
+
+	r, err := s.reading("bridge", "predictive/in", []byte(`{"Hostname": "edge", "SensorID": 7, "Reading": 1.5, "data": "1.5", "quantity": "current"}`), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Hostname != "edge" || r.SensorID != 7 || r.Reading != 1.5 || r.Quantity != "current" {
+		t.Errorf("unexpected reading %+v", r)
+	}
+}
+
+// subscribingClient answers the subscriptions with its tokens, in order.
+type subscribingClient struct {
+	mqtt.Client
+	lock       sync.Mutex
+	tokens     []*fakeToken
+	subscribed int
+}
+
+func (c *subscribingClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.subscribed++
+	var t = c.tokens[0]
+	if len(c.tokens) > 1 {
+		c.tokens = c.tokens[1:]
+	}
+	return t
+}
+
+func (c *subscribingClient) IsConnectionOpen() bool {
+	return true
+}
+
+type fakeToken struct {
+	mqtt.Token
+	timeout bool
+	err     error
+}
+
+func (t *fakeToken) WaitTimeout(time.Duration) bool {
+	return !t.timeout
+}
+
+func (t *fakeToken) Error() error {
+	return t.err
+}
+
+func TestMQTTSubscribeRetries(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.MQTT.Broker = "tcp://localhost:1883"
+	cfg.MQTT.Subscriptions = []mqttSubscription{{Topic: "plant/{sensor}"}}
+	var devices = newDeviceRegistry()
+	var mb = newMQTTBridge(cfg, NewSSEBroker(), devices)
+	mb.minBackoff = time.Millisecond
+
+	var c = &subscribingClient{tokens: []*fakeToken{{timeout: true}, {err: errors.New("not authorized")}, {}}}
+	mb.onConnect(c)
+
+	var h = mb.Health()[0]
+	if h.Status != componentUp {
+		t.Errorf("got health %+v", h)
+	}
+	if ds := devices.Devices(); len(ds) != 1 || ds[0].Errors != 2 {
+		t.Errorf("got devices %+v", ds)
+	}
+	if c.subscribed != 3 {
+		t.Errorf("subscribed %d times, want 3", c.subscribed)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	notifyMinBackoff = 5 * time.Second
+	notifyMaxBackoff = 5 * time.Minute
+	notifyTimeout    = 30 * time.Second // of one attempt
+	notifyQueue      = 100              // notifications waiting for delivery, more are dropped
+)
+
+// The default templates of the notifications, they are executed with the
+// alarm, alarm_escalated or alarm_cleared event.
+const (
+	defaultNotifySubject  = `{{template "title" .}}: {{.Quantity}} {{with .Asset}}of {{.}}{{else}}on {{.Hostname}}{{end}}`
+	defaultNotifyTemplate = `{{template "title" .}}: {{.Quantity}} of sensor {{.SensorID}} on {{.Hostname}}{{with .Asset}} ({{.}}){{end}} is {{.Data}} {{.Unit}}, the band is {{.MinAlarm}} to {{.MaxAlarm}}, at {{.PublishedAt.Format "2006-01-02 15:04:05 MST"}}`
+)
+
+// notifyTitle names the event, the templates can use it as {{template "title" .}}.
+const notifyTitle = `{{define "title"}}{{if eq .Event "alarm_cleared"}}Cleared{{else if eq .Event "alarm_escalated"}}Unacknowledged alarm{{else}}Alarm{{end}}{{end}}`
+
+// notifyChannel is where the notifications go.
+type notifyChannel struct {
+	Name     string   `json:"name"`     // referenced by the routes
+	Type     string   `json:"type"`     // email, webhook (the reading as JSON), slack or teams (incoming webhooks)
+	URL      string   `json:"url"`      // of the webhook
+	SMTP     string   `json:"smtp"`     // host:port of the mail server
+	Username string   `json:"username"` // SMTP auth, if set
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`  // template of the mail subject, see defaultNotifySubject
+	Template string   `json:"template"` // template of the message, see defaultNotifyTemplate
+}
+
+// notifyRoute sends the alarms of an asset to channels. The asset * matches
+// all alarms, an empty asset those of the sensors without asset.
+type notifyRoute struct {
+	Asset    string   `json:"asset"`
+	Channels []string `json:"channels"`
+}
+
+// notifyTarget is a channel with its parsed templates.
+type notifyTarget struct {
+	notifyChannel
+	subject *template.Template
+	text    *template.Template
+}
+
+func newNotifyTarget(c notifyChannel) (*notifyTarget, error) {
+	switch c.Type {
+	case "email":
+		if c.SMTP == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("channel %s: email needs smtp, from and to", c.Name)
+		}
+	case "webhook", "slack", "teams":
+		if c.URL == "" {
+			return nil, fmt.Errorf("channel %s: %s needs a url", c.Name, c.Type)
+		}
+	default:
+		return nil, fmt.Errorf("channel %s: unknown type %q", c.Name, c.Type)
+	}
+
+	var subject, text = c.Subject, c.Template
+	if subject == "" {
+		subject = defaultNotifySubject
+	}
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+
+	var t = &notifyTarget{notifyChannel: c}
+	var err error
+	if t.subject, err = template.New("subject").Parse(notifyTitle + subject); err != nil {
+		return nil, fmt.Errorf("channel %s: subject: %s", c.Name, err)
+	}
+	if t.text, err = template.New("text").Parse(notifyTitle + text); err != nil {
+		return nil, fmt.Errorf("channel %s: template: %s", c.Name, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, r reading) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// send makes one attempt to deliver the notification of r.
+func (t *notifyTarget) send(ctx context.Context, client *http.Client, r reading) error {
+	text, err := render(t.text, r)
+	if err != nil {
+		return err
+	}
+
+	switch t.Type {
+	case "email":
+		subject, err := render(t.subject, r)
+		if err != nil {
+			return err
+		}
+		return t.mail(ctx, subject, text)
+	case "slack", "teams":
+		// both take the text of a simple message
+		return t.post(ctx, client, map[string]string{"text": text})
+	default:
+		return t.post(ctx, client, struct {
+			reading
+			Message string `json:"message"`
+		}{r, text})
+	}
+}
+
+// post posts the payload as JSON to the webhook.
+func (t *notifyTarget) post(ctx context.Context, client *http.Client, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// mail sends the notification as plain text mail, as smtp.SendMail but
+// within the notify timeout or until the context is cancelled.
+func (t *notifyTarget) mail(ctx context.Context, subject, text string) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.SMTP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// a cancelled context ends the conversation with the server
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	host, _, _ := net.SplitHostPort(t.SMTP)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if t.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", t.Username, t.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", t.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(t.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+
+	if err = c.Mail(t.From); err != nil {
+		return err
+	}
+	for _, to := range t.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// notification is a reading waiting for delivery to a channel.
+type notification struct {
+	target *notifyTarget
+	r      reading
+}
+
+// rateLimited is a stream notifying a channel, within the rate limit.
+type rateLimited struct {
+	sent    time.Time
+	event   string        // of the last notification sent
+	pending *notification // the latest held back, sent at the end of the limit
+}
+
+// notifier sends the alarm transitions of the alarm tracker to the channels
+// their asset is routed to. A stream notifies a channel at most once per
+// rate limit, the transitions within it are coalesced into the latest, which
+// is sent when the limit ends unless it is back in the state last sent. A
+// failed delivery is retried with a backoff.
+type notifier struct {
+	targets   map[string]*notifyTarget // by name
+	routes    []notifyRoute
+	rateLimit time.Duration
+	retries   int
+	client    *http.Client
+	queue     chan notification
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	lock sync.Mutex
+	last map[string]*rateLimited // by channel and stream
+}
+
+func newNotifier(cfg *config) (*notifier, error) {
+	var nt = &notifier{
+		targets:    make(map[string]*notifyTarget),
+		routes:     cfg.Notify.Routes,
+		rateLimit:  time.Duration(cfg.Notify.RateLimit) * time.Millisecond,
+		retries:    cfg.Notify.Retries,
+		client:     &http.Client{Timeout: notifyTimeout},
+		queue:      make(chan notification, notifyQueue),
+		minBackoff: notifyMinBackoff,
+		maxBackoff: notifyMaxBackoff,
+		last:       make(map[string]*rateLimited),
+	}
+	if nt.retries <= 0 {
+		nt.retries = 1
+	}
+
+	for _, c := range cfg.Notify.Channels {
+		if _, ok := nt.targets[c.Name]; ok {
+			return nil, fmt.Errorf("channel %s: defined twice", c.Name)
+		}
+		t, err := newNotifyTarget(c)
+		if err != nil {
+			return nil, err
+		}
+		nt.targets[c.Name] = t
+	}
+
+	for _, route := range nt.routes {
+		for _, name := range route.Channels {
+			if _, ok := nt.targets[name]; !ok {
+				return nil, fmt.Errorf("route %q: unknown channel %s", route.Asset, name)
+			}
+		}
+	}
+	return nt, nil
+}
+
+// channels returns the names of the channels the alarms of an asset go to,
+// all without routes.
+func (nt *notifier) channels(asset string) []string {
+	var names []string
+	if len(nt.routes) == 0 {
+		for name := range nt.targets {
+			names = append(names, name)
+		}
+		return names
+	}
+
+	var seen = make(map[string]bool)
+	for _, route := range nt.routes {
+		if route.Asset != "*" && route.Asset != asset {
+			continue
+		}
+		for _, name := range route.Channels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Observe is registered as observer of the broker, after the alarm tracker.
+func (nt *notifier) Observe(r reading) {
+	if r.Event != "alarm" && r.Event != "alarm_cleared" {
+		return
+	}
+	for _, name := range nt.channels(r.Asset) {
+		nt.Notify(name, r)
+	}
+}
+
+// Notify queues the notification of r to a channel. Within the rate limit
+// of the stream on the channel it is held back until the limit ends instead,
+// replacing the one held back before. It returns whether the notification
+// was queued at once.
+func (nt *notifier) Notify(channel string, r reading) bool {
+	var t, ok = nt.targets[channel]
+	if !ok {
+		return false
+	}
+
+	var key = channel + "/" + r.stream()
+	var now = time.Now()
+	nt.lock.Lock()
+	if rl, ok := nt.last[key]; ok && now.Sub(rl.sent) < nt.rateLimit {
+		if rl.pending != nil {
+			notificationsSent.WithLabelValues(channel, "limited").Inc()
+		} else {
+			time.AfterFunc(nt.rateLimit-now.Sub(rl.sent), func() { nt.release(key) })
+		}
+		rl.pending = &notification{target: t, r: r}
+		nt.lock.Unlock()
+		return false
+	}
+	nt.last[key] = &rateLimited{sent: now, event: r.Event}
+	nt.lock.Unlock()
+
+	return nt.enqueue(notification{target: t, r: r})
+}
+
+// release queues the notification held back at the end of a rate limit.
+func (nt *notifier) release(key string) {
+	nt.lock.Lock()
+	var rl = nt.last[key]
+	var n = rl.pending
+	rl.pending = nil
+	if n.r.Event == rl.event {
+		// flapped back
+		nt.lock.Unlock()
+		notificationsSent.WithLabelValues(n.target.Name, "limited").Inc()
+		return
+	}
+	rl.sent, rl.event = time.Now(), n.r.Event
+	nt.lock.Unlock()
+
+	nt.enqueue(*n)
+}
+
+func (nt *notifier) enqueue(n notification) bool {
+	select {
+	case nt.queue <- n:
+		return true
+	default:
+		log.Println("Notifications of", n.target.Name, "are backing up, dropping", n.r.stream())
+		notificationsSent.WithLabelValues(n.target.Name, "dropped").Inc()
+		return false
+	}
+}
+
+// Run delivers the queued notifications until the context is cancelled.
+func (nt *notifier) Run(ctx context.Context) {
+	var wg = sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-nt.queue:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				nt.deliver(ctx, n)
+			}()
+		}
+	}
+}
+
+// deliver sends a notification, retrying with a backoff.
+func (nt *notifier) deliver(ctx context.Context, n notification) {
+	var bo = newBackoff(nt.minBackoff, nt.maxBackoff)
+	for attempt := 1; ; attempt++ {
+		var err = n.target.send(ctx, nt.client, n.r)
+		if err == nil {
+			notificationsSent.WithLabelValues(n.target.Name, "sent").Inc()
+			return
+		}
+		if attempt >= nt.retries {
+			log.Printf("Notifying %s of %s: %s, giving up\n", n.target.Name, n.r.stream(), err)
+			notificationsSent.WithLabelValues(n.target.Name, "failed").Inc()
+			return
+		}
+
+		log.Printf("Notifying %s of %s: %s, retrying in %s\n", n.target.Name, n.r.stream(), err, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStandIn accepts mails and hands their data to the test.
+func smtpStandIn(t *testing.T) (net.Listener, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mails = make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var rd = bufio.NewReader(conn)
+				var reply = func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+				reply("220 stand-in")
+				var data []string
+				var inData = false
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+
+					switch {
+					case inData && line == ".":
+						inData = false
+						mails <- strings.Join(data, "\n")
+						reply("250 queued")
+					case inData:
+						data = append(data, line)
+					case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+						reply("250 stand-in")
+					case line == "DATA":
+						inData = true
+						reply("354 go ahead")
+					case line == "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("250 ok")
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return ln, mails
+}
+
+func alarmEvent(event string) reading {
+	return reading{
+		Hostname:    "edge1",
+		SensorID:    7,
+		Quantity:    "temperature",
+		Unit:        "°C",
+		Asset:       "gearbox-1",
+		Data:        "1650",
+		MinAlarm:    800,
+		MaxAlarm:    1500,
+		Event:       event,
+		PublishedAt: time.Date(2019, 6, 1, 3, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestNotifierChannels(t *testing.T) {
+	var lock sync.Mutex
+	var bodies = make(map[string][]byte)
+	var posted = make(chan string, 10)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies[r.URL.Path] = body
+		lock.Unlock()
+		posted <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	var ln, mails = smtpStandIn(t)
+	defer ln.Close()
+
+	var cfg = defaultConfig()
+	cfg.Notify.Channels = []notifyChannel{
+		{Name: "hook", Type: "webhook", URL: srv.URL + "/hook"},
+		{Name: "chat", Type: "slack", URL: srv.URL + "/chat", Template: "{{.Event}} {{.Asset}} {{.Data}}"},
+		{Name: "mail", Type: "email", SMTP: ln.Addr().String(), From: "predictive@plant", To: []string{"night@plant"}},
+		{Name: "press", Type: "webhook", URL: srv.URL + "/press"},
+	}
+	cfg.Notify.Routes = []notifyRoute{
+		{Asset: "gearbox-1", Channels: []string{"chat", "mail"}},
+		{Asset: "*", Channels: []string{"hook"}},
+		{Asset: "press", Channels: []string{"press"}},
+	}
+	nt, err := newNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go nt.Run(ctx)
+
+	nt.Observe(alarmEvent("alarm"))
+	// not an alarm transition
+	nt.Observe(reading{Hostname: "edge1", SensorID: 7, Quantity: "temperature", Data: "1650", Asset: "gearbox-1"})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-posted:
+			if path == "/press" {
+				t.Error("notified the channel of another asset")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("webhooks not posted")
+		}
+	}
+
+	lock.Lock()
+	var chat map[string]string
+	json.Unmarshal(bodies["/chat"], &chat)
+	if chat["text"] != "alarm gearbox-1 1650" {
+		t.Errorf("slack message %q", chat["text"])
+	}
+	var hook map[string]interface{}
+	json.Unmarshal(bodies["/hook"], &hook)
+	if hook["asset"] != "gearbox-1" || !strings.HasPrefix(hook["message"].(string), "Alarm: temperature of sensor 7 on edge1 (gearbox-1) is 1650 °C") {
+		t.Errorf("webhook payload %v", hook)
+	}
+	lock.Unlock()
+
+	select {
+	case mail := <-mails:
+		if !strings.Contains(mail, "Subject: Alarm: temperature of gearbox-1") || !strings.Contains(mail, "To: night@plant") {
+			t.Errorf("unexpected mail %q", mail)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no mail")
+	}
+}
+
+func TestNotifierMailTimeout(t *testing.T) {
+	// accepts, but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	target, err := newNotifyTarget(notifyChannel{Name: "mail", Type: "email", SMTP: ln.Addr().String(), From: "alarms@plant", To: []string{"night@plant"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var started = time.Now()
+	if err = target.send(ctx, nil, alarmEvent("alarm")); err == nil {
+		t.Error("mail to a silent server sent")
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("gave up after %s", time.Since(started))
+	}
+}
+
+func TestNotifierRateLimitAndRetry(t *testing.T) {
+	var lock sync.Mutex
+	var attempts = 0
+	var delivered = make(chan string, 10)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var n reading
+		json.Unmarshal(body, &n)
+		delivered <- n.Event
+	}))
+	defer srv.Close()
+
+	var cfg = defaultConfig()
+	cfg.Notify.Channels = []notifyChannel{{Name: "hook", Type: "webhook", URL: srv.URL}}
+	cfg.Notify.RateLimit = 200
+	cfg.Notify.Retries = 3
+	nt, err := newNotifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt.minBackoff = time.Millisecond
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go nt.Run(ctx)
+
+	var expect = func(event string) {
+		t.Helper()
+		select {
+		case got := <-delivered:
+			if got != event {
+				t.Errorf("delivered %s, want %s", got, event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not delivered", event)
+		}
+	}
+
+	if !nt.Notify("hook", alarmEvent("alarm")) {
+		t.Fatal("first alarm not queued")
+	}
+	// flapping, it ends cleared
+	for _, event := range []string{"alarm_cleared", "alarm", "alarm_cleared"} {
+		if nt.Notify("hook", alarmEvent(event)) {
+			t.Errorf("%s within the rate limit queued", event)
+		}
+	}
+	expect("alarm")
+	expect("alarm_cleared")
+	lock.Lock()
+	if attempts != 3 {
+		t.Errorf("%d attempts, want 3", attempts)
+	}
+	lock.Unlock()
+
+	// flapping back into the state last sent
+	nt.Notify("hook", alarmEvent("alarm"))
+	nt.Notify("hook", alarmEvent("alarm_cleared"))
+	select {
+	case got := <-delivered:
+		t.Errorf("delivered %s after flapping back", got)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestNotifierConfig(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.Notify.Channels = []notifyChannel{{Name: "hook", Type: "webhook", URL: "http://localhost/"}}
+	cfg.Notify.Routes = []notifyRoute{{Asset: "*", Channels: []string{"pager"}}}
+	if _, err := newNotifier(cfg); err == nil {
+		t.Error("route to an unknown channel accepted")
+	}
+
+	cfg.Notify.Routes = nil
+	cfg.Notify.Channels[0].Template = "{{.Missing"
+	if _, err := newNotifier(cfg); err == nil {
+		t.Error("broken template accepted")
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// stOPCUA is the SensorType of the readings of an OPC UA server.
+const stOPCUA uint16 = 0xad00
+
+const (
+	opcuaMinBackoff = time.Second
+	opcuaMaxBackoff = time.Minute
+)
+
+var errOPCUAClosed = errors.New("connection closed")
+
+// opcuaServerConfig is an OPC UA server, e.g. a SCADA, and the nodes to monitor.
+type opcuaServerConfig struct {
+	Endpoint string      `json:"endpoint"` // e.g. opc.tcp://scada:4840
+	Name     string      `json:"name"`     // the SensorID is derived from it, the endpoint if empty
+	Username string      `json:"username"` // anonymous if empty
+	Password string      `json:"password"`
+	Interval int         `json:"interval"` // publishing interval of the subscription in ms
+	Nodes    []opcuaNode `json:"nodes"`
+}
+
+// opcuaNode is a monitored item.
+type opcuaNode struct {
+	NodeID   string  `json:"node_id"`  // e.g. ns=2;s=Gearbox1.Temperature
+	Sensor   string  `json:"sensor"`   // the SensorID is derived from it, the name of the server if empty
+	Quantity string  `json:"quantity"` // the node id if empty
+	Unit     string  `json:"unit"`
+	MinAlarm float64 `json:"min_alarm"`
+	MaxAlarm float64 `json:"max_alarm"`
+}
+
+// opcuaValue converts the value of a data change, booleans count as 0 and 1.
+func opcuaValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case int8:
+		return float64(x), true
+	case uint8:
+		return float64(x), true
+	case int16:
+		return float64(x), true
+	case uint16:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// opcuaCollector subscribes the nodes of OPC UA servers, every server on its own.
+type opcuaCollector struct {
+	clients []*opcuaClient
+}
+
+func newOPCUACollector(cfg *config, sseBroker *SSEBroker, devices *deviceRegistry) (*opcuaCollector, error) {
+	var oc = &opcuaCollector{}
+	for _, s := range cfg.OPCUA {
+		var name = s.Name
+		if name == "" {
+			name = s.Endpoint
+		}
+
+		var oa = &opcuaClient{
+			hostnamePlus: cfg.Hostname,
+			server:       s,
+			sensorID:     sensorIDFromName(name),
+			sseBroker:    sseBroker,
+			devices:      devices,
+			state:        newComponentState(),
+			minBackoff:   opcuaMinBackoff,
+			maxBackoff:   opcuaMaxBackoff,
+		}
+
+		for _, n := range s.Nodes {
+			id, err := ua.ParseNodeID(n.NodeID)
+			if err != nil {
+				return nil, fmt.Errorf("opcua %s %s: %s", s.Endpoint, n.NodeID, err)
+			}
+			oa.nodeIDs = append(oa.nodeIDs, id)
+		}
+
+		oc.clients = append(oc.clients, oa)
+	}
+	return oc, nil
+}
+
+// Run monitors all servers until the context is cancelled.
+func (oc *opcuaCollector) Run(ctx context.Context) {
+	var wg = sync.WaitGroup{}
+	for _, oa := range oc.clients {
+		wg.Add(1)
+		go func(oa *opcuaClient) {
+			defer wg.Done()
+			oa.run(ctx)
+		}(oa)
+	}
+	wg.Wait()
+}
+
+// Health reports the connection to every server.
+func (oc *opcuaCollector) Health() []componentHealth {
+	var hs []componentHealth
+	for _, oa := range oc.clients {
+		hs = append(hs, oa.state.health("opcua", oa.server.Endpoint))
+	}
+	return hs
+}
+
+// opcuaClient monitors the nodes of one server. The client handle of a
+// monitored item is the index of its node.
+type opcuaClient struct {
+	hostnamePlus string
+	server       opcuaServerConfig
+	nodeIDs      []*ua.NodeID
+	sensorID     uint32
+	sseBroker    *SSEBroker
+	devices      *deviceRegistry
+	state        *componentState
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// run keeps a session with the server, reconnecting with an exponential backoff.
+func (oa *opcuaClient) run(ctx context.Context) {
+	var bo = newBackoff(oa.minBackoff, oa.maxBackoff)
+	for {
+		var started = time.Now()
+		var err = oa.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > oa.maxBackoff {
+			bo.Reset()
+		}
+
+		oa.publishFailure(oa.sensorID, err, time.Now())
+		oa.devices.Disconnected(oa.server.Endpoint)
+		oa.state.Down(err)
+
+		collectorReconnects.WithLabelValues("opcua").Inc()
+		log.Printf("OPC UA %s: %s, reconnecting in %s\n", oa.server.Endpoint, err, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// session connects, subscribes the nodes and publishes their data changes
+// until the context is cancelled or the connection is lost.
+func (oa *opcuaClient) session(ctx context.Context) error {
+	var opts = []opcua.Option{
+		opcua.SecurityMode(ua.MessageSecurityModeNone),
+		opcua.AutoReconnect(false), // reconnected by run, as the other collectors
+	}
+	if oa.server.Username != "" {
+		opts = append(opts, opcua.AuthUsername(oa.server.Username, oa.server.Password))
+	} else {
+		opts = append(opts, opcua.AuthAnonymous())
+	}
+
+	c, err := opcua.NewClient(oa.server.Endpoint, opts...)
+	if err != nil {
+		return err
+	}
+	if err = c.Connect(ctx); err != nil {
+		return err
+	}
+	defer c.Close(context.Background())
+
+	var notifications = make(chan *opcua.PublishNotificationData)
+	sub, err := c.Subscribe(ctx, &opcua.SubscriptionParameters{
+		Interval: time.Duration(oa.server.Interval) * time.Millisecond,
+	}, notifications)
+	if err != nil {
+		return fmt.Errorf("subscribing: %s", err)
+	}
+	defer sub.Cancel(context.Background())
+
+	var items []*ua.MonitoredItemCreateRequest
+	for i, id := range oa.nodeIDs {
+		items = append(items, opcua.NewMonitoredItemCreateRequestWithDefaults(id, ua.AttributeIDValue, uint32(i)))
+	}
+	res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, items...)
+	if err != nil {
+		return fmt.Errorf("monitoring: %s", err)
+	}
+	for i, r := range res.Results {
+		if r.StatusCode != ua.StatusOK {
+			oa.publishFailure(oa.nodeSensorID(i), fmt.Errorf("%s: %s", oa.server.Nodes[i].NodeID, r.StatusCode), time.Now())
+		}
+	}
+
+	oa.devices.Connected(oa.server.Endpoint, "opcua", oa.hostnamePlus, oa.server.Endpoint, oa.sensorID)
+	oa.state.Up()
+	log.Println("OPC UA", oa.server.Endpoint, "connected")
+
+	// the client reports a lost connection only through its state
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if c.State() != opcua.Connected {
+				return errOPCUAClosed
+			}
+		case n := <-notifications:
+			if n.Error != nil {
+				oa.publishFailure(oa.sensorID, n.Error, time.Now())
+				continue
+			}
+			if dc, ok := n.Value.(*ua.DataChangeNotification); ok {
+				oa.dataChange(dc)
+			}
+		}
+	}
+}
+
+// nodeSensorID returns the SensorID of the i-th node.
+func (oa *opcuaClient) nodeSensorID(i int) uint32 {
+	if sensor := oa.server.Nodes[i].Sensor; sensor != "" {
+		return sensorIDFromName(sensor)
+	}
+	return oa.sensorID
+}
+
+// dataChange publishes the values of a data change notification.
+func (oa *opcuaClient) dataChange(dc *ua.DataChangeNotification) {
+	for _, item := range dc.MonitoredItems {
+		var i = int(item.ClientHandle)
+		if i >= len(oa.server.Nodes) || item.Value == nil {
+			continue
+		}
+		var node = oa.server.Nodes[i]
+		var sensorID = oa.nodeSensorID(i)
+
+		var at = item.Value.SourceTimestamp
+		if at.IsZero() {
+			at = time.Now()
+		}
+
+		if item.Value.Status != ua.StatusOK {
+			oa.publishFailure(sensorID, fmt.Errorf("%s: %s", node.NodeID, item.Value.Status), at)
+			continue
+		}
+
+		var v, ok = 0.0, false
+		if item.Value.Value != nil {
+			v, ok = opcuaValue(item.Value.Value.Value())
+		}
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			oa.publishFailure(sensorID, fmt.Errorf("%s: no numeric value", node.NodeID), at)
+			continue
+		}
+
+		var quantity = node.Quantity
+		if quantity == "" {
+			quantity = node.NodeID
+		}
+
+		oa.devices.Reading(oa.server.Endpoint, at)
+		oa.sseBroker.NewReading(reading{
+			Hostname:    oa.hostnamePlus,
+			SensorID:    sensorID,
+			SensorType:  stOPCUA,
+			Reading:     v,
+			Quantity:    quantity,
+			Unit:        node.Unit,
+			Data:        strconv.FormatFloat(v, 'f', -1, 64),
+			MinAlarm:    node.MinAlarm,
+			MaxAlarm:    node.MaxAlarm,
+			PublishedAt: at,
+		})
+	}
+}
+
+// publishFailure reports a failure of the server or a node as an error event.
+func (oa *opcuaClient) publishFailure(sensorID uint32, err error, at time.Time) {
+	oa.devices.Failure(oa.server.Endpoint, err, at)
+	oa.sseBroker.NewReading(reading{
+		Hostname:    oa.hostnamePlus,
+		SensorID:    sensorID,
+		SensorType:  stOPCUA,
+		Event:       "error",
+		Data:        err.Error(),
+		PublishedAt: at,
+	})
+}
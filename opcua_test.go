@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestOPCUAValue(t *testing.T) {
+	var tests = []struct {
+		v    interface{}
+		want float64
+		ok   bool
+	}{
+		{float32(72.5), 72.5, true},
+		{int16(-3), -3, true},
+		{uint32(7), 7, true},
+		{true, 1, true},
+		{"running", 0, false},
+	}
+
+	for _, tt := range tests {
+		if v, ok := opcuaValue(tt.v); v != tt.want || ok != tt.ok {
+			t.Errorf("%T %v: got %v, %v", tt.v, tt.v, v, ok)
+		}
+	}
+}
+
+func TestOPCUADataChange(t *testing.T) {
+	var cfg = defaultConfig()
+	cfg.Hostname = "test"
+	cfg.OPCUA = []opcuaServerConfig{{
+		Endpoint: "opc.tcp://localhost:4840",
+		Name:     "scada",
+		Nodes: []opcuaNode{
+			{NodeID: "ns=2;s=Gearbox1.Temperature", Quantity: "temperature", Unit: "°C", MaxAlarm: 80},
+			{NodeID: "ns=2;s=Motor1.Current", Sensor: "motor1", Quantity: "current", Unit: "A"},
+		},
+	}}
+
+	var broker = NewSSEBroker()
+	var ch = make(chan []byte, 10)
+	broker.AddClient(ch)
+
+	var devices = newDeviceRegistry()
+	oc, err := newOPCUACollector(cfg, broker, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var at = time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	oc.clients[0].dataChange(&ua.DataChangeNotification{
+		MonitoredItems: []*ua.MonitoredItemNotification{
+			{ClientHandle: 0, Value: &ua.DataValue{Value: ua.MustVariant(float32(85.5)), Status: ua.StatusOK, SourceTimestamp: at}},
+			{ClientHandle: 1, Value: &ua.DataValue{Value: ua.MustVariant(int32(12)), Status: ua.StatusOK}},
+			{ClientHandle: 1, Value: &ua.DataValue{Status: ua.StatusBadSensorFailure}},
+		},
+	})
+
+	var rs = collectEach(t, ch, "temperature", "current")
+	var temperature = rs["temperature"]
+	if temperature.Reading != 85.5 || temperature.SensorID != sensorIDFromName("scada") || temperature.SensorType != stOPCUA ||
+		temperature.Alarm != "true" || !temperature.PublishedAt.Equal(at) {
+		t.Errorf("unexpected reading %+v", temperature)
+	}
+	if current := rs["current"]; current.Reading != 12.0 || current.SensorID != sensorIDFromName("motor1") {
+		t.Errorf("unexpected reading %+v", current)
+	}
+
+	var ds = devices.Devices()
+	if len(ds) != 1 || ds[0].Readings != 2 || ds[0].Errors != 1 {
+		t.Errorf("unexpected device %+v", ds)
+	}
+}
+
+// collectEach reads a reading of each quantity from the broker, the broker
+// sends to each client in its own goroutine so they arrive in any order.
+func collectEach(t *testing.T, ch chan []byte, quantities ...string) map[string]reading {
+	var wanted = make(map[string]bool)
+	for _, q := range quantities {
+		wanted[q] = true
+	}
+	var rs = make(map[string]reading)
+	var timeout = time.After(2 * time.Second)
+	for len(rs) < len(wanted) {
+		select {
+		case <-timeout:
+			t.Fatalf("got readings %v, want %v", rs, quantities)
+		case b := <-ch:
+			var r reading
+			json.Unmarshal(b, &r)
+			if r.Event == "" && wanted[r.Quantity] {
+				rs[r.Quantity] = r
+			}
+		}
+	}
+	return rs
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -15,6 +18,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	logging "github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	debug "github.com/tj/go-debug"
 
 	client "github.com/influxdata/influxdb/client/v2"
@@ -23,17 +28,15 @@ import (
 var logger = logging.MustGetLogger("main")
 var dbg = debug.Debug("bluez:main")
 
-var adapterID = "hci0"
-
-var tagAddresses = []string{"24:71:89:C0:23:80"} // , "CC:78:AB:7F:72:84"}
-
 const avgRateOfChange = 0.4 // 0.04C per minute, 1.0C every 20 mins
 const minAlarm = 500
 const maxAlarm = 1500
 
 //SensorTagTemperatureExample example of reading temperature from a TI sensortag
 
-func webserver(broker *SSEBroker) {
+// webserver serves the dashboard and the APIs until the context is cancelled,
+// the SSE streams are ended with a last "shutdown" event first.
+func webserver(ctx context.Context, listen string, broker *SSEBroker, devices *deviceRegistry, alarms *alarmTracker, maintenance *maintenanceSchedule, history *historyStore, annotations *annotationStore, health *healthChecks) {
 	var r = gin.Default()
 	r.LoadHTMLGlob("templates/*.html")
 
@@ -76,8 +79,14 @@ func webserver(broker *SSEBroker) {
 	var locker = sync.RWMutex{}
 
 	go func() {
+		var ticker = time.NewTicker(time.Second * 60)
+		defer ticker.Stop()
 		for {
-			time.Sleep(time.Second * 60)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 			locker.Lock()
 			i = 0
 			locker.Unlock()
@@ -114,7 +123,11 @@ func webserver(broker *SSEBroker) {
 			}
 			locker.RUnlock()
 
-			time.Sleep(time.Millisecond * 75)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Millisecond * 75):
+			}
 			locker.Lock()
 			i++
 			locker.Unlock()
@@ -147,9 +160,11 @@ func webserver(broker *SSEBroker) {
 		var err error
 		var rv reading
 		if err = c.BindJSON(&rv); err != nil {
+			ingestErrors.WithLabelValues("post").Inc()
 			c.AbortWithStatus(500)
 			return
 		}
+		ingestReadings.WithLabelValues("post").Inc()
 
 		// var fn = "data/x_" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".json"
 
@@ -161,6 +176,152 @@ func webserver(broker *SSEBroker) {
 		return
 	})
 
+	// batches of the agents, see agent
+	r.POST("/api/ingest", func(c *gin.Context) {
+		rs, err := decodeIngest(c.Request.Body, c.GetHeader("Content-Encoding"))
+		if err != nil {
+			ingestErrors.WithLabelValues("ingest").Inc()
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		ingestReadings.WithLabelValues("ingest").Add(float64(len(rs)))
+
+		for _, rv := range rs {
+			broker.NewReading(rv)
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"accepted": len(rs)})
+	})
+
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	r.GET("/api/devices", func(c *gin.Context) {
+		c.JSON(http.StatusOK, devices.Devices())
+	})
+
+	r.GET("/api/alarms", func(c *gin.Context) {
+		c.JSON(http.StatusOK, alarms.Alarms())
+	})
+	// stops the escalation of the alarm, e.g. {"stream": "edge1/2311/temperature", "by": "anna"}
+	r.POST("/api/alarms/ack", func(c *gin.Context) {
+		var ack struct {
+			Stream string `json:"stream"`
+			By     string `json:"by"`
+		}
+		if err := json.NewDecoder(c.Request.Body).Decode(&ack); err != nil || ack.By == "" {
+			c.String(http.StatusBadRequest, "stream and by are required")
+			return
+		}
+		if err := alarms.Acknowledge(ack.Stream, ack.By); err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"acknowledged": ack.Stream})
+	})
+
+	r.GET("/api/maintenance", func(c *gin.Context) {
+		c.JSON(http.StatusOK, maintenance.Windows())
+	})
+	// without start the window starts now, without end it is open until deleted,
+	// e.g. {"asset": "gearbox-1", "reason": "oil change", "by": "anna"}
+	r.POST("/api/maintenance", func(c *gin.Context) {
+		var w maintenanceWindow
+		if err := json.NewDecoder(c.Request.Body).Decode(&w); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		w, err := maintenance.Add(w)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusCreated, w)
+	})
+	// ends the window now, or cancels it if it has not started yet
+	r.DELETE("/api/maintenance/:id", func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid id")
+			return
+		}
+		if err = maintenance.End(id); err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// e.g. {"asset": "gearbox-1", "start": "2019-06-01T08:00:00Z", "end": "2019-06-01T09:30:00Z", "text": "bearing replaced", "by": "anna"}
+	r.POST("/api/annotations", func(c *gin.Context) {
+		var a annotation
+		if err := json.NewDecoder(c.Request.Body).Decode(&a); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		a.Source = ""
+		a, err := annotations.Add(a)
+		if err == errAnnotationText || err == errAnnotationRange {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusCreated, a)
+	})
+	// ?asset=gearbox-1&stream=edge1/2311/temperature&from=2019-06-01T00:00:00Z&to=..., all optional
+	r.GET("/api/annotations", func(c *gin.Context) {
+		from, to, err := parseTimeRange(c.Query("from"), c.Query("to"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, annotations.Between(c.Query("asset"), c.Query("stream"), from, to))
+	})
+	// the readings kept in memory with their annotations, takes the parameters of /api/annotations
+	r.GET("/api/history", func(c *gin.Context) {
+		from, to, err := parseTimeRange(c.Query("from"), c.Query("to"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		var asset, stream = c.Query("asset"), c.Query("stream")
+		var rs = history.Between(asset, stream, from, to)
+		if asset == "" && stream != "" && len(rs) > 0 {
+			// the annotations of the asset of the stream, too
+			asset = rs[0].Asset
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"readings":    rs,
+			"annotations": annotations.Between(asset, stream, from, to),
+		})
+	})
+
+	// the web server answers, so it is up
+	var started = time.Now()
+	health.Add(healthFunc(func() []componentHealth {
+		return []componentHealth{{Kind: "web", Name: listen, Status: componentUp, Since: started, Critical: true}}
+	}))
+
+	// for the liveness and the readiness probes, 503 fails them
+	r.GET("/healthz", func(c *gin.Context) {
+		var cs = health.Components()
+		if !health.Healthy(cs) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "failing", "components": cs})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "components": cs})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		var cs = health.Components()
+		if !health.Ready(cs) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "components": cs})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "components": cs})
+	})
+
 	r.OPTIONS("/t", func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.AbortWithStatus(http.StatusOK)
@@ -177,59 +338,53 @@ func webserver(broker *SSEBroker) {
 
 		notify := c.Writer.(http.CloseNotifier).CloseNotify()
 
-		go func() {
-			<-notify
-			broker.RemoveClient(tempChangeCh)
-		}()
+		// values of each stream, by hostname, sensor and quantity
+		var historicValues = make(map[string][]float64)
 
-		// var readings = make(map[uint32][]reading)
-		var historicValues = make([]float64, 0)
-
-		var lastReading *reading
+		// time of the last reading of each stream, older ones are out of order
+		var lastPublished = make(map[string]time.Time)
 
 		for {
-			var thisVal = <-tempChangeCh
+			var thisVal []byte
+			select {
+			case thisVal = <-tempChangeCh:
+			case <-notify:
+				return
+			case <-broker.Done():
+				// tells the dashboard the server went away on purpose, it reconnects after the retry
+				m, _ := json.Marshal(reading{Event: "shutdown", PublishedAt: time.Now()})
+				c.Writer.Write([]byte(fmt.Sprintf("retry: %d\ndata: %s\n\n", sseRetry/time.Millisecond, string(m))))
+				c.Writer.Flush()
+				return
+			}
 
 			var tc reading
 			json.Unmarshal(thisVal, &tc)
 
-			if lastReading == nil {
-				lastReading = &tc
+			// per stream, the batches of the agents arrive late but in order
+			var stream = tc.stream()
+			if last, ok := lastPublished[stream]; ok && tc.PublishedAt.Before(last) {
+				continue
 			}
-
-			log.Println(tc.PublishedAt, lastReading.PublishedAt, tc.PublishedAt.Before(lastReading.PublishedAt))
-
-			if tc.PublishedAt.Before(lastReading.PublishedAt) {
+			lastPublished[stream] = tc.PublishedAt
+
+			if tc.Event != "" || tc.Meta {
+				// lifecycle events carry no value to average, the
+				// telemetry of a sensor brings its own alarm limits
+				m, _ := json.Marshal(tc)
+				c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", string(m))))
+				c.Writer.Flush()
 				continue
 			}
 
-			lastReading = &tc
-
-			// if _, ok := readings[tc.SensorID]; !ok {
-			// 	readings[tc.SensorID] = make([]reading, 0)
-			// }
-
-			// for i := 0; i < len(readings[tc.SensorID]); i++ {
+			var key = stream
 			d, _ := strconv.ParseFloat(tc.Data, 64)
 
-			historicValues = append(historicValues, d)
-			// }
-
-			tc.MinAlarm = 800
-			tc.MaxAlarm = 1500
-
-			// if len(historicValues) > 15 {
-			// log.Println(historicValues)
-			ma := calculateMA("", historicValues, 30)
-			// _, lr := calculateLR("", historicValues, 30)
-
-			formatted, _ := strconv.ParseFloat(fmt.Sprintf("%.2f", ma), 64)
-			tc.CE = formatted
-			tc.TE = 1000
-			tc.MRE = 900
-			// tc.TUF = lr
+			if !tc.Maintenance {
+				historicValues[key] = append(historicValues[key], d)
+			}
 
-			// }
+			predict(&tc, historicValues[key])
 
 			m, _ := json.Marshal(tc)
 			log.Println("thisVal", string(m))
@@ -239,7 +394,26 @@ func webserver(broker *SSEBroker) {
 		}
 	})
 
-	log.Fatal(r.Run("0.0.0.0:80"))
+	var srv = &http.Server{Addr: listen, Handler: r}
+	var failed = make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// the streams never go idle, they are ended before the server waits for them
+	broker.Close()
+
+	var shutdownCtx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Stopping the web server:", err)
+	}
 }
 
 // queryDB convenience function to query the database
@@ -259,9 +433,143 @@ func queryDB(clnt client.Client, cmd string) (res []client.Result, err error) {
 	return res, nil
 }
 
+// runCollectors starts the configured collectors under the supervisor, they
+// stop with its context and close their connections.
+func runCollectors(sv *supervisor, cfg *config, broker *SSEBroker, devices *deviceRegistry, health *healthChecks) {
+	if cfg.MQTT.Broker != "" {
+		var mb = newMQTTBridge(cfg, broker, devices)
+		broker.AddObserver(mb.Observe)
+		health.Add(mb)
+		sv.Go("mqtt", mb.Run)
+	}
+
+	if len(cfg.Brickd) > 0 {
+		bc, err := newBrickerCollector(cfg, broker, devices)
+		if err != nil {
+			log.Fatal(err)
+		}
+		health.Add(bc)
+		sv.Go("brickd", bc.Run)
+	}
+
+	if len(cfg.Modbus) > 0 {
+		mc, err := newModbusCollector(cfg, broker, devices)
+		if err != nil {
+			log.Fatal(err)
+		}
+		health.Add(mc)
+		sv.Go("modbus", mc.Run)
+	}
+
+	if len(cfg.OPCUA) > 0 {
+		oc, err := newOPCUACollector(cfg, broker, devices)
+		if err != nil {
+			log.Fatal(err)
+		}
+		health.Add(oc)
+		sv.Go("opcua", oc.Run)
+	}
+
+	if len(cfg.BLE.Tags) > 0 || len(cfg.BLE.Beacons) > 0 {
+		adapters, err := newBLEAdapters(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		health.Add(bleAdaptersHealth(adapters))
+		// after the tags and the scans are done with them
+		sv.OnShutdown("ble adapters", func(ctx context.Context) error {
+			return closeBLEAdapters(adapters)
+		})
+
+		var telemetry = newWirelessTelemetry(cfg, broker, devices)
+
+		if len(cfg.BLE.Tags) > 0 {
+			var bc = newBLECollector(cfg, adapters, broker, devices, telemetry)
+			sv.Go("ble", bc.Run)
+		}
+
+		if len(cfg.BLE.Beacons) > 0 {
+			var bs = newBeaconScanner(cfg, adapters, broker, devices, telemetry)
+			sv.Go("beacons", bs.Run)
+		}
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent(os.Args[2:])
+		return
+	}
+
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var sv = newSupervisor()
 	var broker = NewSSEBroker()
+	var devices = newDeviceRegistry()
+	broker.AddFilter(newGatewaySelector().Accept)
+	broker.AddFilter(newAssetRegistry(cfg.Assets).Tag)
+	maintenance, err := newMaintenanceSchedule(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	broker.AddFilter(maintenance.Mark)
+	var alarms = newAlarmTracker(broker)
+	broker.AddObserver(alarms.Observe)
+	var history = newHistoryStore(cfg)
+	broker.AddObserver(history.Observe)
+	annotations, err := openAnnotationStore(cfg.Annotations)
+	if err != nil {
+		log.Fatal(err)
+	}
+	broker.AddObserver(annotations.Observe)
+	sv.OnShutdown("annotations", func(ctx context.Context) error {
+		return annotations.Close()
+	})
+
+	var nt *notifier
+	if len(cfg.Notify.Channels) > 0 {
+		if nt, err = newNotifier(cfg); err != nil {
+			log.Fatal(err)
+		}
+		broker.AddObserver(nt.Observe)
+		sv.Go("notifier", nt.Run)
+	}
+	if len(cfg.Escalation.Policies) > 0 {
+		if nt == nil {
+			log.Fatal("The escalation needs notify channels")
+		}
+		es, err := newEscalator(cfg, nt, maintenance)
+		if err != nil {
+			log.Fatal(err)
+		}
+		broker.AddObserver(es.Observe)
+		sv.Go("escalation", es.Run)
+	}
+
+	var sensors = newSensorMetrics()
+	broker.AddObserver(sensors.Observe)
+	prometheus.MustRegister(sensors)
+	registerBrokerMetrics(broker)
+	registerAlarmMetrics(alarms)
+
+	var health = newHealthChecks()
+	if cfg.Prometheus.RemoteWrite != "" {
+		var rw = newRemoteWriter(cfg)
+		broker.AddObserver(rw.Observe)
+		health.Add(rw)
+		sv.Go("remote write", rw.Run)
+		// the samples of the last interval
+		sv.OnShutdown("remote write", rw.Flush)
+	}
+
+	runCollectors(sv, cfg, broker, devices, health)
+
+	sv.Go("web", func(ctx context.Context) {
+		webserver(ctx, cfg.Listen, broker, devices, alarms, maintenance, history, annotations, health)
+	})
 
-	webserver(broker)
-	// readSensors("localhost", broker)
+	sv.Wait()
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueSuffix = ".json.gz"
+
+// diskQueue is a FIFO of batches in a directory, one file per batch, so the
+// batches survive a restart. A batch is written to a temporary file first and
+// renamed, a crash leaves no half batch behind.
+type diskQueue struct {
+	dir string
+	max int // batches kept, the oldest are dropped beyond
+
+	lock   sync.Mutex
+	last   int64         // name of the newest batch
+	pushed chan struct{} // signalled after a push
+}
+
+func openDiskQueue(dir string, max int) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var q = &diskQueue{
+		dir:    dir,
+		max:    max,
+		pushed: make(chan struct{}, 1),
+	}
+
+	names, err := q.names()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		q.last, _ = strconv.ParseInt(strings.TrimSuffix(names[len(names)-1], queueSuffix), 10, 64)
+		log.Printf("Queue %s: %d batches left from before\n", dir, len(names))
+	}
+
+	return q, nil
+}
+
+// names returns the batches, oldest first.
+func (q *diskQueue) names() ([]string, error) {
+	var infos, err = ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), queueSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Push appends a batch.
+func (q *diskQueue) Push(batch []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var started = time.Now()
+	defer func() { storageWrites.WithLabelValues("queue").Observe(time.Since(started).Seconds()) }()
+
+	// named by time, the zero padding keeps them sorted
+	var seq = time.Now().UnixNano()
+	if seq <= q.last {
+		seq = q.last + 1
+	}
+	q.last = seq
+
+	var name = fmt.Sprintf("%020d%s", seq, queueSuffix)
+	var tmp = filepath.Join(q.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, batch, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		return err
+	}
+
+	// queued, even if the oldest are not dropped
+	if err := q.trim(); err != nil {
+		log.Println("Trimming the queue", q.dir+":", err)
+	}
+
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// trim drops the oldest batches beyond the maximum.
+func (q *diskQueue) trim() error {
+	if q.max <= 0 {
+		return nil
+	}
+
+	names, err := q.names()
+	if err != nil {
+		return err
+	}
+
+	for len(names) > q.max {
+		log.Println("Queue", q.dir, "is full, dropping", names[0])
+		if err = os.Remove(filepath.Join(q.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Peek returns the oldest batch, an empty name if there is none.
+func (q *diskQueue) Peek() (string, []byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	names, err := q.names()
+	if err != nil || len(names) == 0 {
+		return "", nil, err
+	}
+
+	batch, err := ioutil.ReadFile(filepath.Join(q.dir, names[0]))
+	if err != nil {
+		return "", nil, err
+	}
+	return names[0], batch, nil
+}
+
+// Remove drops a batch returned by Peek.
+func (q *diskQueue) Remove(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var err = os.Remove(filepath.Join(q.dir, name))
+	if os.IsNotExist(err) {
+		// trimmed in the meantime
+		return nil
+	}
+	return err
+}
+
+// Len returns the number of queued batches.
+func (q *diskQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	names, _ := q.names()
+	return len(names)
+}
+
+// Pushed is signalled after a batch was pushed.
+func (q *diskQueue) Pushed() <-chan struct{} {
+	return q.pushed
+}
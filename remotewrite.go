@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteWriteTimeout = 30 * time.Second // of one push
+	remoteWriteMax     = 100000           // samples kept while the endpoint is down, the oldest are dropped beyond
+)
+
+// remoteSample is one sample of a series, the labels include the metric
+// name as __name__ and are sorted by name.
+type remoteSample struct {
+	labels [][2]string
+	value  float64
+	at     int64 // ms since the epoch
+}
+
+// remoteWriter pushes the readings to a Prometheus remote write endpoint, as
+// the same series and with the same predictions the scrape of /metrics has,
+// but with every reading and its own timestamp.
+type remoteWriter struct {
+	url      string
+	username string
+	password string
+	interval time.Duration
+	client   *http.Client
+	state    *componentState
+
+	lock    sync.Mutex
+	pending []remoteSample
+	history map[string][]float64 // by stream
+}
+
+func newRemoteWriter(cfg *config) *remoteWriter {
+	var rw = &remoteWriter{
+		url:      cfg.Prometheus.RemoteWrite,
+		username: cfg.Prometheus.Username,
+		password: cfg.Prometheus.Password,
+		interval: time.Duration(cfg.Prometheus.Interval) * time.Millisecond,
+		client:   &http.Client{Timeout: remoteWriteTimeout},
+		history:  make(map[string][]float64),
+		state:    newComponentState(),
+	}
+	if rw.interval <= 0 {
+		rw.interval = 10 * time.Second
+	}
+	// up until a push fails
+	rw.state.Up()
+	return rw
+}
+
+// Observe is registered as observer of the broker.
+func (rw *remoteWriter) Observe(r reading) {
+	if r.Event != "" {
+		return
+	}
+	var v, ok = sensorValue(r)
+	if !ok {
+		return
+	}
+
+	var at = r.PublishedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	var ms = at.UnixNano() / int64(time.Millisecond)
+
+	var labels = map[string]string{
+		"host":     r.Hostname,
+		"sensor":   strconv.FormatUint(uint64(r.SensorID), 10),
+		"type":     strconv.FormatUint(uint64(r.SensorType), 10),
+		"asset":    r.Asset,
+		"quantity": r.Quantity,
+	}
+
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	rw.add("predictive_sensor_value", labels, r.Unit, v, ms)
+
+	if !r.Meta {
+		var stream = r.stream()
+		if !r.Maintenance {
+			rw.history[stream] = appendHistory(rw.history[stream], v)
+		}
+		predict(&r, rw.history[stream])
+
+		rw.add("predictive_sensor_ce", labels, "", r.CE, ms)
+		rw.add("predictive_sensor_te", labels, "", r.TE, ms)
+		rw.add("predictive_sensor_mre", labels, "", r.MRE, ms)
+		rw.add("predictive_sensor_tuf", labels, "", r.TUF, ms)
+	}
+
+	if len(rw.pending) > remoteWriteMax {
+		rw.pending = rw.pending[len(rw.pending)-remoteWriteMax:]
+	}
+}
+
+// add appends a sample to the pending ones, empty labels are left out as
+// Prometheus does not tell them from missing ones.
+func (rw *remoteWriter) add(name string, labels map[string]string, unit string, v float64, ms int64) {
+	var s = remoteSample{
+		labels: [][2]string{{"__name__", name}},
+		value:  v,
+		at:     ms,
+	}
+	for n, value := range labels {
+		if value != "" {
+			s.labels = append(s.labels, [2]string{n, value})
+		}
+	}
+	if unit != "" {
+		s.labels = append(s.labels, [2]string{"unit", unit})
+	}
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i][0] < s.labels[j][0] })
+
+	rw.pending = append(rw.pending, s)
+}
+
+// Health reports the remote write endpoint as the storage. It is an
+// optional export, the dashboard and the ingest serve without it.
+func (rw *remoteWriter) Health() []componentHealth {
+	return []componentHealth{rw.state.health("storage", rw.url)}
+}
+
+// Run pushes the pending samples every interval until the context is
+// cancelled, the samples of a failed push are retried with the next one.
+func (rw *remoteWriter) Run(ctx context.Context) {
+	var ticker = time.NewTicker(rw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := rw.Flush(ctx); err != nil {
+			log.Printf("Remote write %s: %s\n", rw.url, err)
+		}
+	}
+}
+
+// Flush pushes the pending samples. They are kept for the next push if the
+// endpoint is unavailable, and dropped if it rejects them.
+func (rw *remoteWriter) Flush(ctx context.Context) error {
+	rw.lock.Lock()
+	var samples = rw.pending
+	rw.pending = nil
+	rw.lock.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	var err = rw.push(ctx, samples)
+	if err == nil || err == errBatchRejected {
+		rw.state.Up()
+	} else {
+		rw.state.Down(err)
+	}
+
+	if err == errBatchRejected {
+		return fmt.Errorf("%d samples rejected, dropping them", len(samples))
+	}
+	if err != nil {
+		rw.lock.Lock()
+		rw.pending = append(samples, rw.pending...)
+		if len(rw.pending) > remoteWriteMax {
+			rw.pending = rw.pending[len(rw.pending)-remoteWriteMax:]
+		}
+		rw.lock.Unlock()
+	}
+	return err
+}
+
+// push sends one write request.
+func (rw *remoteWriter) push(ctx context.Context, samples []remoteSample) error {
+	var started = time.Now()
+	defer func() { storageWrites.WithLabelValues("remote_write").Observe(time.Since(started).Seconds()) }()
+
+	var body = snappy.Encode(nil, encodeWriteRequest(samples))
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if rw.username != "" {
+		req.SetBasicAuth(rw.username, rw.password)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		// e.g. out of order samples, retrying does not help
+		return errBatchRejected
+	default:
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+}
+
+// encodeWriteRequest encodes the samples as prometheus.WriteRequest, one
+// series per sample:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []remoteSample) []byte {
+	var req []byte
+	for _, s := range samples {
+		var series []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l[1])
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.at))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, series)
+	}
+	return req
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries is a series of a write request as the endpoint sees it.
+type decodedSeries struct {
+	labels map[string]string
+	value  float64
+	at     int64
+}
+
+// decodeWriteRequest decodes what encodeWriteRequest encoded.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	var fields = func(b []byte, fn func(num protowire.Number, v []byte, x uint64)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch typ {
+			case protowire.BytesType:
+				v, n := protowire.ConsumeBytes(b)
+				fn(num, v, 0)
+				b = b[n:]
+			case protowire.Fixed64Type:
+				x, n := protowire.ConsumeFixed64(b)
+				fn(num, nil, x)
+				b = b[n:]
+			case protowire.VarintType:
+				x, n := protowire.ConsumeVarint(b)
+				fn(num, nil, x)
+				b = b[n:]
+			default:
+				t.Fatalf("unexpected wire type %d", typ)
+			}
+		}
+	}
+
+	var series []decodedSeries
+	fields(b, func(_ protowire.Number, ts []byte, _ uint64) {
+		var s = decodedSeries{labels: make(map[string]string)}
+		fields(ts, func(num protowire.Number, v []byte, _ uint64) {
+			if num == 1 {
+				var name, value string
+				fields(v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				s.labels[name] = value
+				return
+			}
+			fields(v, func(num protowire.Number, _ []byte, x uint64) {
+				if num == 1 {
+					s.value = math.Float64frombits(x)
+				} else {
+					s.at = int64(x)
+				}
+			})
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+func TestRemoteWriter(t *testing.T) {
+	var lock sync.Mutex
+	var received []decodedSeries
+	var fail = true
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("encoding %q", r.Header.Get("Content-Encoding"))
+		}
+		if user, password, _ := r.BasicAuth(); user != "grafana" || password != "secret" {
+			t.Errorf("basic auth %q %q", user, password)
+		}
+
+		compressed, _ := ioutil.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, decodeWriteRequest(t, b)...)
+	}))
+	defer srv.Close()
+
+	var cfg = defaultConfig()
+	cfg.Prometheus.RemoteWrite = srv.URL
+	cfg.Prometheus.Username = "grafana"
+	cfg.Prometheus.Password = "secret"
+	var rw = newRemoteWriter(cfg)
+
+	var at = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	rw.Observe(reading{Hostname: "edge1", SensorID: 7, SensorType: stModbus, Asset: "press", Quantity: "temperature", Unit: "°C", Reading: 21.5, PublishedAt: at})
+	rw.Observe(reading{Hostname: "edge1", SensorID: 7, Asset: "press", Quantity: "battery", Unit: "%", Data: "80", Meta: true, PublishedAt: at})
+	rw.Observe(reading{Hostname: "edge1", SensorID: 7, Event: "error", Data: "lost"})
+
+	// kept while the endpoint is down
+	if err := rw.Flush(context.Background()); err == nil {
+		t.Fatal("no error from an unavailable endpoint")
+	}
+	var hc = newHealthChecks()
+	hc.Add(rw)
+	if cs := hc.Components(); cs[0].Status != componentDown || !hc.Ready(cs) {
+		t.Errorf("endpoint down: %+v, ready %v", cs, hc.Ready(cs))
+	}
+	lock.Lock()
+	fail = false
+	lock.Unlock()
+	if err := rw.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// value, ce, te, mre and tuf of the temperature, the value of the battery
+	if len(received) != 6 {
+		t.Fatalf("%d series, want 6: %v", len(received), received)
+	}
+
+	var first = received[0]
+	var want = map[string]string{
+		"__name__": "predictive_sensor_value",
+		"host":     "edge1",
+		"sensor":   "7",
+		"type":     "44032",
+		"asset":    "press",
+		"quantity": "temperature",
+		"unit":     "°C",
+	}
+	for name, value := range want {
+		if first.labels[name] != value {
+			t.Errorf("label %s is %q, want %q", name, first.labels[name], value)
+		}
+	}
+	if first.value != 21.5 || first.at != at.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("sample %v at %d", first.value, first.at)
+	}
+
+	if received[2].labels["__name__"] != "predictive_sensor_te" || received[2].value != 1000 {
+		t.Errorf("series %v, want the target", received[2])
+	}
+	if received[5].labels["quantity"] != "battery" || received[5].value != 80 {
+		t.Errorf("series %v, want the battery", received[5])
+	}
+}
@@ -19,25 +19,30 @@ You need the bricker api code.
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
 	"log"
+	"math"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/dirkjabl/bricker"
 	"github.com/dirkjabl/bricker/connector/buffered"
 	"github.com/dirkjabl/bricker/device"
-	"github.com/dirkjabl/bricker/device/bricklet/moisture"
-	"github.com/dirkjabl/bricker/device/bricklet/temperature"
 	"github.com/dirkjabl/bricker/device/enumerate"
 	"github.com/dirkjabl/bricker/device/identity"
 )
 
 const (
-	cn                   = "ws" // connectorname
-	blTemperature uint16 = 216  // Temperature bricklet device identifer
-	blMoisture    uint16 = 232  // Temperature bricklet device identifer
+	cn                           = "ws" // connectorname
+	blTemperature         uint16 = 216  // Temperature bricklet device identifer
+	blMoisture            uint16 = 232  // Moisture bricklet device identifer
+	blHumidity            uint16 = 27   // Humidity bricklet device identifer
+	blBarometer           uint16 = 221  // Barometer bricklet device identifer
+	blAmbientLight        uint16 = 21   // Ambient light bricklet device identifer
+	blAnalogIn            uint16 = 219  // Analog in bricklet device identifer
+	blIndustrialDual020mA uint16 = 228  // Industrial dual 0-20mA bricklet device identifer
 )
 
 type reading struct {
@@ -47,8 +52,13 @@ type reading struct {
 	Reading     interface{}
 	MinAlarm    float64
 	MaxAlarm    float64
+	Quantity    string    `json:"quantity"` // what was measured, e.g. temperature
+	Unit        string    `json:"unit"`
+	Asset       string    `json:"asset"` // machine the sensor is mounted on, see assetRegistry
 	Data        string    `json:"data"`
 	Event       string    `json:"event"`
+	Meta        bool      `json:"meta"`        // about the sensor itself, e.g. battery or signal strength
+	Maintenance bool      `json:"maintenance"` // taken while the asset was in maintenance, see maintenanceSchedule
 	PublishedAt time.Time `json:"published_at"`
 
 	Alarm string `json:"alarm"`
@@ -59,6 +69,11 @@ type reading struct {
 	TUF float64 `json:"tuf"`
 }
 
+// stream names the series a reading belongs to, by hostname, sensor and quantity.
+func (r reading) stream() string {
+	return fmt.Sprintf("%s/%d/%s", r.Hostname, r.SensorID, r.Quantity)
+}
+
 type ByPublishedAt []reading
 
 func (a ByPublishedAt) Len() int           { return len(a) }
@@ -71,181 +86,430 @@ type bricklet struct {
 	sub          *device.Device // subscriber
 	brickletType uint16         // bricklet type
 	uid          uint32         // uid
+	name         string         // uid as printed by brickv (base58)
+	listener     *listener      // listening to the bricklet, if running
+}
+
+// listener is one run of listen.
+type listener struct {
+	cancel  context.CancelFunc
+	turnOff bool          // turn the callback off when cancelled, set before cancel
+	done    chan struct{} // closed when listen returned
 }
 
-// Data structur, remembers which bricklet exists, what for a address to use and the bricker.
-var conf struct {
+// stop stops listening to the bricklet and returns the listener to wait
+// for, nil if none was running. The callback is only turned off while the
+// connection is up, a bricklet that is gone does not answer.
+func (b *bricklet) stop(turnOff bool) *listener {
+	var l = b.listener
+	if l != nil {
+		l.turnOff = turnOff
+		l.cancel()
+		b.listener = nil
+	}
+	return l
+}
+
+const (
+	brickdMinBackoff = time.Second      // first wait after a lost connection
+	brickdMaxBackoff = time.Minute      // upper bound for the wait between attempts
+	brickdHeartbeat  = 10 * time.Second // interval of the enumerate heartbeat
+	brickdDeadAfter  = 3                // missed heartbeats before reconnecting
+	brickletOff      = 2 * time.Second  // wait for a bricklet to turn its callback off
+)
+
+// brickerCollector reads the bricklets of one or more brick stacks.
+type brickerCollector struct {
+	stacks []*brickStack // one per brickd
+}
+
+// brickStack remembers which bricklets exist behind one brickd and the bricker used to talk to it.
+type brickStack struct {
 	addr          string               // address of the stack
+	hostnamePlus  string               // hostname stamped on every reading
 	brick         *bricker.Bricker     // bricker
-	showOnConsole bool                 // show output from the LCD on the console, too
+	showOnConsole bool                 // show output on the console, too
 	bricklets     map[uint32]*bricklet // Map with all supportet bricklets
+	sseBroker     *SSEBroker
+	devices       *deviceRegistry
+	defaultPeriod time.Duration            // callback period of the bricklets
+	periods       map[string]time.Duration // callback period by bricklet uid
+	state         *componentState          // of the connection to the brickd
 
 	brickletLock sync.RWMutex
+	lastSeen     time.Time // last enumeration answer, guarded by brickletLock
 }
 
-// main routine, will startup.
-func readSensors(hostnamePlus string, sseBroker *SSEBroker) {
-	// need the address of the stack with the weatherstation kit bricklets.
-	var addr = flag.String("addr", "localhost:4223",
-		"address of the brickd, default is localhost:4223")
-	var soc = flag.Bool("console", false,
-		"show output from lcd on the console, too: default false")
-	flag.Parse()
-
-	// create map for the bricklets
-	conf.brickletLock.Lock()
-	conf.bricklets = make(map[uint32]*bricklet)
-	conf.brickletLock.Unlock()
-
-	// conf.bricklets = map[uint16]*bricklet{
-	// 	bl_lcd: &bricklet{has: false, cb: workLcd}, // LCD 20x4
-	// 	// bl_humidity:     &bricklet{has: false, cb: workHumidity},     // humidity
-	// 	// bl_barometer:    &bricklet{has: false, cb: workBarometer},    // barometer
-	// 	// bl_ambientlight: &bricklet{has: false, cb: workAmbientlight}, // ambient light
-	// 	blTemperature: &bricklet{has: false, cb: workTemp}, // temperature
-	// }
-
-	// remember the flags
-	conf.addr = *addr
-	conf.showOnConsole = *soc
-
-	// Create a bricker object
-	conf.brick = bricker.New()
-	defer conf.brick.Done() // later for stopping the bricker
-
-	var conn *buffered.ConnectorBuffered
-	var err error
-
-	for conn == nil {
-		// create a connection to a real brick stack
-		conn, err = buffered.New(conf.addr, 20, 10)
-		if err != nil { // no connection
-			fmt.Printf("No connection, sleeping for 5: %s\n", err.Error())
-			time.Sleep(5 * time.Second)
-		}
-	}
-	log.Println(">>>>>>>>>>>>>>> Connected to BrickD")
+func newBrickerCollector(cfg *config, sseBroker *SSEBroker, devices *deviceRegistry) (*brickerCollector, error) {
+	var bc = &brickerCollector{}
+
+	// a period of 0 turns the callback off
+	if cfg.BrickletPeriod <= 0 {
+		return nil, fmt.Errorf("invalid bricklet period %d ms", cfg.BrickletPeriod)
+	}
+	var periods = make(map[string]time.Duration)
+	for uid, ms := range cfg.BrickletPeriods {
+		if ms <= 0 {
+			return nil, fmt.Errorf("bricklet %s: invalid period %d ms", uid, ms)
+		}
+		periods[uid] = time.Duration(ms) * time.Millisecond
+	}
+
+	for _, addr := range cfg.Brickd {
+		bc.stacks = append(bc.stacks, &brickStack{
+			addr:          addr,
+			hostnamePlus:  cfg.Hostname,
+			showOnConsole: cfg.Console,
+			bricklets:     make(map[uint32]*bricklet),
+			sseBroker:     sseBroker,
+			devices:       devices,
+			defaultPeriod: time.Duration(cfg.BrickletPeriod) * time.Millisecond,
+			periods:       periods,
+			state:         newComponentState(),
+		})
+	}
+
+	return bc, nil
+}
+
+// Run reads all stacks until the context is cancelled.
+func (bc *brickerCollector) Run(ctx context.Context) {
+	var wg = sync.WaitGroup{}
+	for _, s := range bc.stacks {
+		wg.Add(1)
+		go func(s *brickStack) {
+			defer wg.Done()
+			s.run(ctx)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// Health reports the connection to every brickd. A session that stopped
+// checking the heartbeat is down and wedged, even if it was not closed.
+func (bc *brickerCollector) Health() []componentHealth {
+	var hs []componentHealth
+	for _, s := range bc.stacks {
+		var h = s.state.health("brickd", s.addr)
+
+		s.brickletLock.RLock()
+		var lastSeen = s.lastSeen
+		s.brickletLock.RUnlock()
+
+		if h.Status == componentUp && time.Since(lastSeen) > 2*brickdDeadAfter*brickdHeartbeat {
+			h.Status = componentDown
+			h.Wedged = true
+			h.Since = lastSeen
+			h.LastError = fmt.Sprintf("no heartbeat since %s", lastSeen.Format(time.RFC3339))
+		}
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// run keeps a connection to the brickd, reconnecting with an exponential backoff.
+func (s *brickStack) run(ctx context.Context) {
+	var bo = newBackoff(brickdMinBackoff, brickdMaxBackoff)
+	for {
+		var started = time.Now()
+		var err = s.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a connection that held for a while starts over with a short wait
+		if time.Since(started) > brickdMaxBackoff {
+			bo.Reset()
+		}
+
+		s.state.Down(err)
+		collectorReconnects.WithLabelValues("brickd").Inc()
+		log.Printf("brickd %s: %s, reconnecting in %s\n", s.addr, err, bo.Next())
+		if !bo.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// session connects to the brickd once and reads the bricklets until
+// the context is cancelled or the brickd stops answering.
+func (s *brickStack) session(ctx context.Context) error {
+	// create a connection to a real brick stack
+	conn, err := buffered.New(s.addr, 20, 10)
+	if err != nil { // no connection
+		return err
+	}
 	defer conn.Done() // later for stopping current connection
 
+	var brick = bricker.New()
+	defer brick.Done() // later for stopping the bricker
+
 	// attach the connector to the bricker
-	err = conf.brick.Attach(conn, cn) // ws is the name for this connection
-	if err != nil {                   // no bricker, no fun
-		fmt.Printf("Could not attach connection to bricker: %s\n", err.Error())
-		return
+	if err = brick.Attach(conn, cn); err != nil { // no bricker, no fun
+		return fmt.Errorf("could not attach connection to bricker: %s", err)
 	}
-	log.Println(">>>>>>>>>>>>>>> Attached to BrickD")
-	defer conf.brick.Release(cn) // later to release connection from bricker
+	defer brick.Release(cn) // later to release connection from bricker
+	log.Println("Connected to brickd", s.addr)
+	s.state.Up()
 
-	var wg = sync.WaitGroup{}
-	wg.Add(1)
+	// the bricklets are gone with the connection, the next enumeration brings
+	// them back. On shutdown the connection is still up, their callbacks are
+	// turned off before it is released.
+	defer func() { s.disconnectAll(ctx.Err() != nil) }()
+
+	s.brickletLock.Lock()
+	s.brick = brick
+	s.lastSeen = time.Now()
+	s.brickletLock.Unlock()
+
+	var heartbeat = time.NewTicker(brickdHeartbeat)
+	defer heartbeat.Stop()
 
 	// Look out for the hardware(bricklets) inside the given stack
-	// hw := make(chan *enumerate.Enumeration, 4)
-	en := enumerate.Enumerate("Enumerate", false,
-		func(r device.Resulter, err error) {
-			if err == nil && r != nil { // only if no error occur
-				if v, ok := r.(*enumerate.Enumeration); ok {
-					// log.Println("V", v)
-					// hw <- v
-					hardwareidentify(v, hostnamePlus, sseBroker)
+	var en *device.Device
+	for {
+		if en != nil {
+			brick.Unsubscribe(en)
+		}
+		en = enumerate.Enumerate("Enumerate", false,
+			func(r device.Resulter, err error) {
+				if err == nil && r != nil { // only if no error occur
+					if v, ok := r.(*enumerate.Enumeration); ok {
+						s.hardwareidentify(v)
+					}
 				}
-			}
-		})
+			})
 
-	// attach enumeration subscriber to the bricker
-	err = conf.brick.Subscribe(en, cn)
+		// attach enumeration subscriber to the bricker
+		if err = brick.Subscribe(en, cn); err != nil {
+			return fmt.Errorf("could not enumerate: %s", err)
+		}
 
-	wg.Wait()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-heartbeat.C:
+		}
+
+		s.brickletLock.RLock()
+		var silent = time.Since(s.lastSeen)
+		s.brickletLock.RUnlock()
 
-	// go on with the program, waiting for a key
-	// fmt.Printf("Press return for stop.\n")
-	// _, _ = bufio.NewReader(os.Stdin).ReadByte()
-	// if conf.bricklets[bl_lcd].has {
-	// _ = lcd20x4.BacklightOffFuture(conf.brick, cn, conf.bricklets[bl_lcd].uid)
-	// }
+		if silent > brickdDeadAfter*brickdHeartbeat {
+			return fmt.Errorf("no answer for %s", silent)
+		}
+	}
+}
+
+// disconnectAll stops listening to all bricklets of the stack and waits
+// until they stopped, turning their callbacks off if turnOff is set.
+func (s *brickStack) disconnectAll(turnOff bool) {
+	var stopped []*listener
+
+	s.brickletLock.Lock()
+	for _, b := range s.bricklets {
+		if b.has {
+			if l := b.stop(turnOff); l != nil {
+				stopped = append(stopped, l)
+			}
+			b.has = false
+			s.publishBrickletEvent(b, "disconnected")
+		}
+	}
+	s.brickletLock.Unlock()
+
+	for _, l := range stopped {
+		<-l.done
+	}
 }
 
 // This handler identify the founded hardware and if possible
 // it starts or stops a handler/callback to read out the sensors or to display.
-func hardwareidentify(value *enumerate.Enumeration, hostnamePlus string, sseBroker *SSEBroker) {
-	var uid uint32
-	if value.EnumerationType != enumerate.EnumerationTypeDisconneted {
-		// exists and is active
-		uid = value.IntUid()
+//
+// A bricklet answers every enumerate request and announces itself again after
+// a power cycle, so the same uid shows up more than once. Only the first
+// announcement and a reconnect start listening, a disconnect stops it.
+func (s *brickStack) hardwareidentify(value *enumerate.Enumeration) {
+	var uid = value.IntUid()
+
+	s.brickletLock.Lock()
+	defer s.brickletLock.Unlock()
+
+	s.lastSeen = time.Now()
+
+	b, known := s.bricklets[uid]
+
+	switch value.EnumerationType {
+	case enumerate.EnumerationTypeDisconneted:
+		if !known || !b.has {
+			return
+		}
+		b.stop(false)
+		b.has = false
+		s.publishBrickletEvent(b, "disconnected")
+		return
+	case enumerate.EnumerationTypeAvailable:
+		if known && b.has {
+			// already running, just the answer to another enumerate
+			return
+		}
+	}
+
+	var event = "connected"
+	if known {
+		// power cycled, its callback is off
+		b.stop(false)
+		event = "reconnected"
 	} else {
-		uid = 0
+		b = &bricklet{uid: uid, name: value.Uid}
+		s.bricklets[uid] = b
 	}
-	// log.Println(value, value.DeviceIdentifer, "uid", uid)
-	conf.brickletLock.Lock()
-	var b = bricklet{
-		has:          true,
-		uid:          uid,
-		brickletType: value.DeviceIdentifer,
+	b.has = true
+	b.brickletType = value.DeviceIdentifer
+
+	driver, ok := brickletDrivers[b.brickletType]
+	if !ok {
+		log.Println("Unknown type", b.brickletType, b.uid)
+		return
 	}
-	conf.bricklets[uid] = &b
 
-	switch b.brickletType {
-	case blTemperature:
-		b.sub = identity.GetIdentity("", b.uid, nilHandler)
+	var ctx context.Context
+	b.listener = &listener{done: make(chan struct{})}
+	ctx, b.listener.cancel = context.WithCancel(context.Background())
 
-		go pollTemperature(&b, cn, hostnamePlus, sseBroker)
-	case blMoisture:
-		b.sub = identity.GetIdentity("", b.uid, nilHandler)
+	b.sub = identity.GetIdentity("", b.uid, nilHandler)
+	go s.listen(ctx, b, b.listener, s.brick, driver)
 
-		go pollMoisture(&b, cn, hostnamePlus, sseBroker)
-	default:
-		log.Println("Unknown type", b.brickletType, b.uid)
+	s.publishBrickletEvent(b, event)
+}
+
+// publishBrickletEvent reports a lifecycle transition of a bricklet.
+func (s *brickStack) publishBrickletEvent(b *bricklet, event string) {
+	log.Println("Bricklet", s.addr, b.uid, event)
+
+	if event == "disconnected" {
+		s.devices.Disconnected(b.name)
+	} else {
+		s.devices.Connected(b.name, "bricklet", s.hostnamePlus, s.addr, b.uid)
 	}
 
-	conf.brickletLock.Unlock()
+	s.sseBroker.NewReading(reading{
+		Hostname:    s.hostnamePlus,
+		SensorID:    b.uid,
+		SensorType:  b.brickletType,
+		Event:       event,
+		PublishedAt: time.Now(),
+	})
 }
 
-func pollTemperature(b *bricklet, connectorName, hostnamePlus string, sseBroker *SSEBroker) {
-	var ticker = time.Tick(time.Millisecond * 1500)
-	for {
-		select {
-		case <-ticker:
-			conf.brickletLock.Lock()
-			var st = time.Now()
-			temp := temperature.GetTemperatureFuture(conf.brick, cn, b.uid)
-			if temp != nil { // only if a result exists, it is a pointer(!)
-				fmt.Printf("Temperature (%d): %02.02f °C (%s)\n", b.uid, temp.Float64(), time.Now().Sub(st))
-			}
-			conf.brickletLock.Unlock()
+// listen starts the period callback of the bricklet and publishes every value
+// it sends until the context is cancelled, then turns the callback off again
+// if the listener says so. The callback handler runs without taking
+// brickletLock, the bricklets do not wait for each other.
+func (s *brickStack) listen(ctx context.Context, b *bricklet, l *listener, brick *bricker.Bricker, driver *brickletDriver) {
+	defer close(l.done)
+
+	var sub = driver.callback(b.uid, func(r device.Resulter, err error) {
+		var at = time.Now()
+		if err == nil && r == nil {
+			err = errNoResult
+		}
 
-			sseBroker.NewReading(reading{
-				Hostname:   hostnamePlus,
-				SensorID:   b.uid,
-				SensorType: b.brickletType,
-				Reading:    temp.Float64(),
-			})
+		var samples []sample
+		if err == nil {
+			samples, err = driver.decode(r)
+		}
+
+		if err != nil {
+			s.publishFailure(b, err, at)
+			return
+		}
+
+		s.publishSamples(b, samples, at)
+	})
+
+	if err := brick.Subscribe(sub, cn); err != nil {
+		s.publishFailure(b, fmt.Errorf("subscribing: %s", err), time.Now())
+		return
+	}
+	defer brick.Unsubscribe(sub)
+
+	var period = s.period(b)
+	if err := driver.setPeriod(brick, cn, b.uid, uint32(period/time.Millisecond)); err != nil {
+		s.publishFailure(b, fmt.Errorf("setting period: %s", err), time.Now())
+		return
+	}
+	log.Println("Listening to", driver.name, b.name, "every", period)
+
+	<-ctx.Done()
+	if !l.turnOff {
+		return
+	}
 
+	// the future has no timeout of its own, it is left behind if the
+	// bricklet does not answer
+	var off = make(chan error, 1)
+	go func() {
+		off <- driver.setPeriod(brick, cn, b.uid, 0)
+	}()
+	select {
+	case err := <-off:
+		if err != nil {
+			log.Println("Turning off the callback of", driver.name, b.name+":", err)
 		}
+	case <-time.After(brickletOff):
+		log.Println("Turning off the callback of", driver.name, b.name+": no answer")
 	}
 }
 
-func pollMoisture(b *bricklet, connectorName, hostnamePlus string, sseBroker *SSEBroker) {
-	var ticker = time.Tick(time.Millisecond * 1500)
-	for {
-		select {
-		case <-ticker:
-			conf.brickletLock.Lock()
-			var st = time.Now()
-			m := moisture.GetMoistureValueFuture(conf.brick, cn, b.uid)
-			if m != nil { // only if a result exists, it is a pointer(!)
-				fmt.Printf("Moisture (%d): %d (%s)\n", b.uid, m.Value, time.Now().Sub(st))
-			}
-			conf.brickletLock.Unlock()
+// period returns the configured callback period of the bricklet.
+func (s *brickStack) period(b *bricklet) time.Duration {
+	if p, ok := s.periods[b.name]; ok {
+		return p
+	}
+	return s.defaultPeriod
+}
 
-			sseBroker.NewReading(reading{
-				Hostname:   hostnamePlus,
-				SensorID:   b.uid,
-				SensorType: b.brickletType,
-				Reading:    m.Value,
-			})
+// publishSamples publishes the valid samples read at the same time from the bricklet.
+func (s *brickStack) publishSamples(b *bricklet, samples []sample, at time.Time) {
+	for _, sm := range samples {
+		if math.IsNaN(sm.Value) || math.IsInf(sm.Value, 0) {
+			s.publishFailure(b, fmt.Errorf("invalid %s %v", sm.Quantity, sm.Value), at)
+			continue
+		}
+
+		if s.showOnConsole {
+			fmt.Printf("%s (%d): %02.02f %s\n", sm.Quantity, b.uid, sm.Value, sm.Unit)
 		}
+
+		s.devices.Reading(b.name, at)
+		s.sseBroker.NewReading(reading{
+			Hostname:    s.hostnamePlus,
+			SensorID:    b.uid,
+			SensorType:  b.brickletType,
+			Reading:     sm.Value,
+			Quantity:    sm.Quantity,
+			Unit:        sm.Unit,
+			Data:        strconv.FormatFloat(sm.Value, 'f', -1, 64),
+			PublishedAt: at,
+		})
 	}
 }
 
+// publishFailure reports a failed read of the bricklet as an error event.
+func (s *brickStack) publishFailure(b *bricklet, err error, at time.Time) {
+	log.Printf("Reading %s (%d): %s\n", s.addr, b.uid, err)
+
+	s.devices.Failure(b.name, err, at)
+	s.sseBroker.NewReading(reading{
+		Hostname:    s.hostnamePlus,
+		SensorID:    b.uid,
+		SensorType:  b.brickletType,
+		Event:       "error",
+		Data:        err.Error(),
+		PublishedAt: at,
+	})
+}
+
 func nilHandler(r device.Resulter, err error) {
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// sensorTagUUID completes the 16 bit part of a TI SensorTag UUID,
+// e.g. aa01 is f000aa01-0451-4000-b000-000000000000.
+func sensorTagUUID(short string) string {
+	return "f000" + short + "04514000b000000000000000"
+}
+
+// sensorTagService is one sensor of the CC2650 SensorTag. Writing enable to
+// the config characteristic switches it on, the period characteristic takes
+// the notification period in units of 10ms.
+type sensorTagService struct {
+	name      string
+	data      string
+	config    string
+	period    string
+	enable    []byte
+	minPeriod byte // in units of 10ms
+
+	// decode turns a notification of the data characteristic into samples.
+	decode func(b []byte) ([]sample, error)
+}
+
+var sensorTagServices = []*sensorTagService{
+	{
+		name:      "temperature",
+		data:      sensorTagUUID("aa01"),
+		config:    sensorTagUUID("aa02"),
+		period:    sensorTagUUID("aa03"),
+		enable:    []byte{0x01},
+		minPeriod: 30,
+		decode:    decodeTMP007,
+	},
+	{
+		name:      "humidity",
+		data:      sensorTagUUID("aa21"),
+		config:    sensorTagUUID("aa22"),
+		period:    sensorTagUUID("aa23"),
+		enable:    []byte{0x01},
+		minPeriod: 10,
+		decode:    decodeHDC1000,
+	},
+	{
+		name:      "pressure",
+		data:      sensorTagUUID("aa41"),
+		config:    sensorTagUUID("aa42"),
+		period:    sensorTagUUID("aa44"),
+		enable:    []byte{0x01},
+		minPeriod: 10,
+		decode:    decodeBMP280,
+	},
+	{
+		name:      "optics",
+		data:      sensorTagUUID("aa71"),
+		config:    sensorTagUUID("aa72"),
+		period:    sensorTagUUID("aa73"),
+		enable:    []byte{0x01},
+		minPeriod: 10,
+		decode:    decodeOPT3001,
+	},
+	{
+		name:   "movement",
+		data:   sensorTagUUID("aa81"),
+		config: sensorTagUUID("aa82"),
+		period: sensorTagUUID("aa83"),
+		// gyroscope, accelerometer and magnetometer on all axes, accelerometer range 8G
+		enable:    []byte{0x7f, mpu9250Range8G},
+		minPeriod: 10,
+		decode:    decodeMPU9250,
+	},
+}
+
+// sensorTagPeriod converts an interval to the period of the service.
+func (s *sensorTagService) sensorTagPeriod(ms int) byte {
+	var period = ms / 10
+	if period < int(s.minPeriod) {
+		return s.minPeriod
+	}
+	if period > 255 {
+		return 255
+	}
+	return byte(period)
+}
+
+func int16LE(b []byte) float64 {
+	return float64(int16(binary.LittleEndian.Uint16(b)))
+}
+
+func uint24LE(b []byte) float64 {
+	return float64(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
+}
+
+func payloadLength(sensor string, b []byte, want int) error {
+	if len(b) != want {
+		return fmt.Errorf("%s: %d bytes, want %d", sensor, len(b), want)
+	}
+	return nil
+}
+
+// decodeTMP007 decodes the IR temperature service: object and die temperature
+// as 14 bit values in 0.03125 °C.
+func decodeTMP007(b []byte) ([]sample, error) {
+	if err := payloadLength("TMP007", b, 4); err != nil {
+		return nil, err
+	}
+
+	return []sample{
+		{Quantity: "temperature", Unit: "°C", Value: float64(int16(binary.LittleEndian.Uint16(b[2:4]))>>2) * 0.03125},
+		{Quantity: "object_temperature", Unit: "°C", Value: float64(int16(binary.LittleEndian.Uint16(b[0:2]))>>2) * 0.03125},
+	}, nil
+}
+
+// decodeHDC1000 decodes the humidity service: temperature and relative humidity.
+func decodeHDC1000(b []byte) ([]sample, error) {
+	if err := payloadLength("HDC1000", b, 4); err != nil {
+		return nil, err
+	}
+
+	var temp = float64(binary.LittleEndian.Uint16(b[0:2]))/65536*165 - 40
+	var hum = float64(binary.LittleEndian.Uint16(b[2:4])&^0x0003) / 65536 * 100
+
+	return []sample{
+		{Quantity: "humidity", Unit: "%RH", Value: hum},
+		{Quantity: "humidity_temperature", Unit: "°C", Value: temp},
+	}, nil
+}
+
+// decodeBMP280 decodes the barometer service: temperature and pressure,
+// both 24 bit values in 0.01 units.
+func decodeBMP280(b []byte) ([]sample, error) {
+	if err := payloadLength("BMP280", b, 6); err != nil {
+		return nil, err
+	}
+
+	return []sample{
+		{Quantity: "pressure", Unit: "hPa", Value: uint24LE(b[3:6]) / 100},
+		{Quantity: "pressure_temperature", Unit: "°C", Value: uint24LE(b[0:3]) / 100},
+	}, nil
+}
+
+// decodeOPT3001 decodes the optical service: illuminance as 12 bit mantissa
+// and 4 bit exponent.
+func decodeOPT3001(b []byte) ([]sample, error) {
+	if err := payloadLength("OPT3001", b, 2); err != nil {
+		return nil, err
+	}
+
+	var raw = binary.LittleEndian.Uint16(b)
+	var m = float64(raw & 0x0fff)
+	var e = float64((raw & 0xf000) >> 12)
+
+	return []sample{
+		{Quantity: "illuminance", Unit: "lx", Value: m * 0.01 * math.Pow(2, e)},
+	}, nil
+}
+
+// accelerometer range of the MPU9250 as written to the movement config
+const (
+	mpu9250Range2G  = 0
+	mpu9250Range4G  = 1
+	mpu9250Range8G  = 2
+	mpu9250Range16G = 3
+)
+
+// decodeMPU9250 decodes the movement service: gyroscope, accelerometer and
+// magnetometer, three axes each. The accelerometer runs with 8G range.
+func decodeMPU9250(b []byte) ([]sample, error) {
+	if err := payloadLength("MPU9250", b, 18); err != nil {
+		return nil, err
+	}
+
+	var gyro = 65536.0 / 500 // raw per deg/s
+	var acc = 32768.0 / 8    // raw per G at 8G range
+	var mag = 32760.0 / 4912 // raw per µT
+
+	var axes = []string{"x", "y", "z"}
+	var samples = make([]sample, 0, 9)
+	for i, axis := range axes {
+		samples = append(samples, sample{Quantity: "gyro_" + axis, Unit: "°/s", Value: int16LE(b[i*2:]) / gyro})
+	}
+	for i, axis := range axes {
+		samples = append(samples, sample{Quantity: "acceleration_" + axis, Unit: "g", Value: int16LE(b[6+i*2:]) / acc})
+	}
+	for i, axis := range axes {
+		samples = append(samples, sample{Quantity: "magnetism_" + axis, Unit: "µT", Value: int16LE(b[12+i*2:]) / mag})
+	}
+
+	return samples, nil
+}
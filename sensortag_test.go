@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// values returns the samples by quantity.
+func values(samples []sample) map[string]float64 {
+	var vs = make(map[string]float64)
+	for _, s := range samples {
+		vs[s.Quantity] = s.Value
+	}
+	return vs
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.01
+}
+
+func TestDecodeTMP007(t *testing.T) {
+	samples, err := decodeTMP007([]byte{0x00, 0x0f, 0x80, 0x0c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vs = values(samples)
+	if vs["temperature"] != 25 || vs["object_temperature"] != 30 {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeHDC1000(t *testing.T) {
+	// 0x6666 is 26 °C, 0x8000 is 50 %RH
+	samples, err := decodeHDC1000([]byte{0x66, 0x66, 0x00, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vs = values(samples)
+	if !near(vs["humidity"], 50) || !near(vs["humidity_temperature"], 26) {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeBMP280(t *testing.T) {
+	// 2150 is 21.50 °C, 101325 is 1013.25 hPa
+	samples, err := decodeBMP280([]byte{0x66, 0x08, 0x00, 0xcd, 0x8b, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vs = values(samples)
+	if !near(vs["pressure"], 1013.25) || !near(vs["pressure_temperature"], 21.5) {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeOPT3001(t *testing.T) {
+	// mantissa 1000, exponent 3
+	samples, err := decodeOPT3001([]byte{0xe8, 0x33})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := values(samples)["illuminance"]; !near(v, 80) {
+		t.Errorf("got %v lx", v)
+	}
+}
+
+func TestDecodeMPU9250(t *testing.T) {
+	var b = make([]byte, 18)
+	// 1 g on z at 8G range is 4096
+	b[10], b[11] = 0x00, 0x10
+	// -250 °/s on x is -32768
+	b[0], b[1] = 0x00, 0x80
+
+	samples, err := decodeMPU9250(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vs = values(samples)
+	if len(samples) != 9 || !near(vs["acceleration_z"], 1) || !near(vs["gyro_x"], -250) || vs["acceleration_x"] != 0 {
+		t.Errorf("got %v", vs)
+	}
+}
+
+func TestDecodeShortPayloads(t *testing.T) {
+	for _, s := range sensorTagServices {
+		if _, err := s.decode([]byte{0x01}); err == nil {
+			t.Errorf("%s decoded a short payload", s.name)
+		}
+	}
+}
@@ -2,30 +2,50 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"sync"
 	"time"
 )
 
 type SSEBroker struct {
 	ConnectedClients map[chan []byte]bool
+	filters          []func(*reading) bool
+	observers        []func(reading)
 	locker           *sync.RWMutex
+	done             chan struct{} // closed by Close
+	closeOnce        sync.Once
 }
 
 func NewSSEBroker() *SSEBroker {
 	return &SSEBroker{
 		ConnectedClients: make(map[chan []byte]bool),
 		locker:           &sync.RWMutex{},
+		done:             make(chan struct{}),
 	}
 }
 
-func (sb *SSEBroker) Monitor() {
-	for {
-		sb.locker.RLock()
-		log.Println("Num Clients", len(sb.ConnectedClients))
-		sb.locker.RUnlock()
-		time.Sleep(time.Second * 15)
-	}
+// sseSendTimeout is how long a message waits for a slow client before it is dropped.
+const sseSendTimeout = 5 * time.Second
+
+// sseRetry is how long the clients wait before they reconnect after a shutdown.
+const sseRetry = 5 * time.Second
+
+// Close tells the clients to end their streams, on shutdown.
+func (sb *SSEBroker) Close() {
+	sb.closeOnce.Do(func() {
+		close(sb.done)
+	})
+}
+
+// Done is closed by Close.
+func (sb *SSEBroker) Done() <-chan struct{} {
+	return sb.done
+}
+
+// Clients returns the number of connected clients.
+func (sb *SSEBroker) Clients() int {
+	sb.locker.RLock()
+	defer sb.locker.RUnlock()
+	return len(sb.ConnectedClients)
 }
 
 func (sb *SSEBroker) AddClient(ch chan []byte) {
@@ -40,13 +60,52 @@ func (sb *SSEBroker) RemoveClient(ch chan []byte) {
 	sb.locker.Unlock()
 }
 
+// AddFilter registers fn to decide which readings are published, a reading
+// fn returns false for is dropped. fn may complete the reading, e.g. with its asset.
+func (sb *SSEBroker) AddFilter(fn func(*reading) bool) {
+	sb.locker.Lock()
+	sb.filters = append(sb.filters, fn)
+	sb.locker.Unlock()
+}
+
+// AddObserver registers fn to be called with every new reading, after it was sent to the clients.
+func (sb *SSEBroker) AddObserver(fn func(reading)) {
+	sb.locker.Lock()
+	sb.observers = append(sb.observers, fn)
+	sb.locker.Unlock()
+}
+
 func (sb *SSEBroker) NewReading(r reading) {
+	sb.locker.RLock()
+	var filters = sb.filters
+	sb.locker.RUnlock()
+
+	for _, fn := range filters {
+		if !fn(&r) {
+			return
+		}
+	}
+
+	if r.Event == "" {
+		checkAlarm(&r)
+	}
+
 	j, _ := json.Marshal(r)
 	sb.locker.RLock()
 	for cl := range sb.ConnectedClients {
 		go func(client chan []byte) {
-			client <- j
+			select {
+			case client <- j:
+				sseMessages.Inc()
+			case <-time.After(sseSendTimeout):
+				sseDropped.Inc()
+			}
 		}(cl)
 	}
+	var observers = sb.observers
 	sb.locker.RUnlock()
+
+	for _, fn := range observers {
+		fn(r)
+	}
 }
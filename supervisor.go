@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds the shutdown, the components and the hooks share it.
+const shutdownTimeout = 20 * time.Second
+
+// shutdownHook is run once the components stopped, e.g. to flush a buffer.
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// supervisor runs the components of the service with a shared context. On
+// SIGINT or SIGTERM, or Stop, it cancels the context, waits for the
+// components to return and then runs the shutdown hooks, the last added
+// first. A second signal exits at once.
+type supervisor struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	running map[string]int // components by name, for the log of a stuck shutdown
+	hooks   []shutdownHook
+}
+
+func newSupervisor() *supervisor {
+	var ctx, cancel = context.WithCancel(context.Background())
+	return &supervisor{
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: shutdownTimeout,
+		running: make(map[string]int),
+	}
+}
+
+// Context is cancelled when the service shuts down.
+func (sv *supervisor) Context() context.Context {
+	return sv.ctx
+}
+
+// Go runs a component until its context is cancelled.
+func (sv *supervisor) Go(name string, run func(ctx context.Context)) {
+	sv.lock.Lock()
+	sv.running[name]++
+	sv.lock.Unlock()
+
+	sv.wg.Add(1)
+	go func() {
+		defer sv.wg.Done()
+		defer func() {
+			sv.lock.Lock()
+			if sv.running[name]--; sv.running[name] == 0 {
+				delete(sv.running, name)
+			}
+			sv.lock.Unlock()
+		}()
+		run(sv.ctx)
+	}()
+}
+
+// OnShutdown adds a hook run after the components stopped.
+func (sv *supervisor) OnShutdown(name string, fn func(ctx context.Context) error) {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+
+	sv.hooks = append(sv.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// Stop starts the shutdown.
+func (sv *supervisor) Stop() {
+	sv.cancel()
+}
+
+// Wait blocks until SIGINT, SIGTERM or Stop and shuts down.
+func (sv *supervisor) Wait() {
+	var sig = make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case s := <-sig:
+		log.Println("Shutting down on", s)
+	case <-sv.ctx.Done():
+		log.Println("Shutting down")
+	}
+
+	go func() {
+		<-sig
+		log.Println("Exiting without shutdown")
+		os.Exit(1)
+	}()
+
+	sv.shutdown()
+}
+
+// shutdown cancels the components, waits for them and runs the hooks.
+func (sv *supervisor) shutdown() {
+	sv.cancel()
+
+	var ctx, cancel = context.WithTimeout(context.Background(), sv.timeout)
+	defer cancel()
+
+	var stopped = make(chan struct{})
+	go func() {
+		sv.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("Components not stopped in time:", sv.stuck())
+	}
+
+	sv.lock.Lock()
+	var hooks = sv.hooks
+	sv.lock.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			log.Printf("Shutting down %s: %s\n", hooks[i].name, err)
+		}
+	}
+}
+
+// stuck returns the names of the components still running.
+func (sv *supervisor) stuck() []string {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+
+	var names []string
+	for name := range sv.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSupervisorShutdown(t *testing.T) {
+	var sv = newSupervisor()
+
+	var lock sync.Mutex
+	var order []string
+	var record = func(s string) {
+		lock.Lock()
+		order = append(order, s)
+		lock.Unlock()
+	}
+
+	sv.Go("collector", func(ctx context.Context) {
+		<-ctx.Done()
+		// closing the connection takes a while
+		time.Sleep(10 * time.Millisecond)
+		record("collector")
+	})
+	sv.OnShutdown("queue", func(ctx context.Context) error {
+		record("queue")
+		return nil
+	})
+	sv.OnShutdown("adapters", func(ctx context.Context) error {
+		record("adapters")
+		return nil
+	})
+
+	go sv.Stop()
+	sv.Wait()
+
+	if want := []string{"collector", "adapters", "queue"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("shut down in order %v, want %v", order, want)
+	}
+}
+
+func TestSupervisorStuckComponent(t *testing.T) {
+	var sv = newSupervisor()
+	sv.timeout = 20 * time.Millisecond
+
+	var release = make(chan struct{})
+	defer close(release)
+	sv.Go("wedged", func(ctx context.Context) {
+		<-release
+	})
+
+	var flushed = false
+	sv.OnShutdown("buffer", func(ctx context.Context) error {
+		flushed = true
+		return nil
+	})
+
+	sv.Stop()
+	sv.shutdown()
+
+	if !flushed {
+		t.Error("buffer not flushed after the timeout")
+	}
+	if stuck := sv.stuck(); !reflect.DeepEqual(stuck, []string{"wedged"}) {
+		t.Errorf("stuck %v, want the wedged component", stuck)
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	var broker = NewSSEBroker()
+	broker.Close()
+	// twice, e.g. by a second shutdown
+	broker.Close()
+
+	select {
+	case <-broker.Done():
+	default:
+		t.Error("streams not ended")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// batteryLevelUUID is the battery level characteristic of the battery service, in %.
+var batteryLevelUUID = normalizeUUID("2a19")
+
+// wirelessTelemetry publishes the link quality, battery and connection uptime
+// of wireless sensors as meta readings and keeps them in the device registry.
+// The battery readings carry the low battery limit, so they raise an alarm.
+type wirelessTelemetry struct {
+	hostnamePlus      string
+	lowBattery        float64 // %
+	lowBatteryVoltage float64 // V
+	sseBroker         *SSEBroker
+	devices           *deviceRegistry
+}
+
+func newWirelessTelemetry(cfg *config, sseBroker *SSEBroker, devices *deviceRegistry) *wirelessTelemetry {
+	return &wirelessTelemetry{
+		hostnamePlus:      cfg.Hostname,
+		lowBattery:        cfg.BLE.LowBattery,
+		lowBatteryVoltage: cfg.BLE.LowBatteryVoltage,
+		sseBroker:         sseBroker,
+		devices:           devices,
+	}
+}
+
+func (wt *wirelessTelemetry) publish(sensorID uint32, sensorType uint16, quantity, unit string, value, minAlarm float64, at time.Time) {
+	wt.sseBroker.NewReading(reading{
+		Hostname:    wt.hostnamePlus,
+		SensorID:    sensorID,
+		SensorType:  sensorType,
+		Reading:     value,
+		Quantity:    quantity,
+		Unit:        unit,
+		Data:        strconv.FormatFloat(value, 'f', -1, 64),
+		MinAlarm:    minAlarm,
+		Meta:        true,
+		PublishedAt: at,
+	})
+}
+
+// RSSI publishes the signal strength a sensor is received with.
+func (wt *wirelessTelemetry) RSSI(address string, sensorID uint32, sensorType uint16, rssi int, at time.Time) {
+	wt.devices.RSSI(address, rssi, at)
+	wt.publish(sensorID, sensorType, "rssi", "dBm", float64(rssi), 0, at)
+}
+
+// Battery publishes the battery level of a sensor in %.
+func (wt *wirelessTelemetry) Battery(address string, sensorID uint32, sensorType uint16, level float64, at time.Time) {
+	wt.devices.Battery(address, level, "%")
+	wt.publish(sensorID, sensorType, "battery", "%", level, wt.lowBattery, at)
+}
+
+// BatteryVoltage publishes the battery voltage of a sensor, the device
+// registry keeps it only for the sensors that report no level.
+func (wt *wirelessTelemetry) BatteryVoltage(address string, sensorID uint32, sensorType uint16, voltage float64, at time.Time) {
+	wt.devices.Battery(address, voltage, "V")
+	wt.publish(sensorID, sensorType, "battery_voltage", "V", voltage, wt.lowBatteryVoltage, at)
+}
+
+// Uptime publishes for how long a sensor is connected.
+func (wt *wirelessTelemetry) Uptime(sensorID uint32, sensorType uint16, since time.Time, at time.Time) {
+	wt.publish(sensorID, sensorType, "uptime", "s", at.Sub(since).Seconds(), 0, at)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// vibrationFeatures describe one window of accelerometer samples.
+type vibrationFeatures struct {
+	RMS      float64   // g
+	Peak     float64   // g
+	Crest    float64   // Peak / RMS
+	Kurtosis float64   // 3 for gaussian noise, higher for impacts of a damaged gear
+	Bands    []float64 // energy of the spectrum between the band edges, g²
+}
+
+// vibrationAnalyzer turns a stream of acceleration vectors into vibration
+// features over a sliding window. The magnitude of the vector is used, its
+// mean over the window (gravity) is removed before the features are computed.
+type vibrationAnalyzer struct {
+	window     int       // samples per window, a power of 2
+	hop        int       // samples between two windows
+	sampleRate float64   // Hz
+	bandEdges  []float64 // Hz, ascending
+
+	samples []float64
+	pending int // samples since the last window
+}
+
+func newVibrationAnalyzer(window, hop int, sampleRate float64, bandEdges []float64) *vibrationAnalyzer {
+	// round down to a power of 2 for the FFT
+	var n = 2
+	for n*2 <= window {
+		n *= 2
+	}
+	if hop <= 0 || hop > n {
+		hop = n
+	}
+
+	if len(bandEdges) < 2 {
+		// four bands of the same width up to the Nyquist frequency
+		var nyquist = sampleRate / 2
+		bandEdges = []float64{0, nyquist / 4, nyquist / 2, nyquist * 3 / 4, nyquist}
+	}
+
+	return &vibrationAnalyzer{
+		window:     n,
+		hop:        hop,
+		sampleRate: sampleRate,
+		bandEdges:  bandEdges,
+		samples:    make([]float64, 0, n),
+	}
+}
+
+// Add adds one acceleration vector in g. It returns the features once a window is full
+// and then every hop samples.
+func (va *vibrationAnalyzer) Add(x, y, z float64) (vibrationFeatures, bool) {
+	if len(va.samples) == va.window {
+		copy(va.samples, va.samples[1:])
+		va.samples = va.samples[:va.window-1]
+	}
+	va.samples = append(va.samples, math.Sqrt(x*x+y*y+z*z))
+	va.pending++
+
+	if len(va.samples) < va.window || va.pending < va.hop {
+		return vibrationFeatures{}, false
+	}
+	va.pending = 0
+
+	return vibrationFeaturesOf(va.samples, va.sampleRate, va.bandEdges), true
+}
+
+// vibrationFeaturesOf computes the features of a window, len(samples) must be a power of 2.
+func vibrationFeaturesOf(samples []float64, sampleRate float64, bandEdges []float64) vibrationFeatures {
+	var n = float64(len(samples))
+
+	var mean float64
+	for _, s := range samples {
+		mean += s
+	}
+	mean /= n
+
+	var f vibrationFeatures
+	var m2, m4 float64
+	var ac = make([]float64, len(samples))
+	for i, s := range samples {
+		var d = s - mean
+		ac[i] = d
+		m2 += d * d
+		m4 += d * d * d * d
+		if math.Abs(d) > f.Peak {
+			f.Peak = math.Abs(d)
+		}
+	}
+	m2 /= n
+	m4 /= n
+
+	f.RMS = math.Sqrt(m2)
+	if f.RMS > 0 {
+		f.Crest = f.Peak / f.RMS
+		f.Kurtosis = m4 / (m2 * m2)
+	}
+
+	// one sided power spectrum with a Hann window
+	var spectrum = make([]complex128, len(ac))
+	for i, d := range ac {
+		var hann = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/(n-1))
+		spectrum[i] = complex(d*hann, 0)
+	}
+	fft(spectrum)
+
+	f.Bands = make([]float64, len(bandEdges)-1)
+	var resolution = sampleRate / n
+	for k := 1; k <= len(spectrum)/2; k++ {
+		var freq = float64(k) * resolution
+		var power = cmplx.Abs(spectrum[k]) * cmplx.Abs(spectrum[k]) * 2 / (n * n)
+		for b := 0; b < len(f.Bands); b++ {
+			if freq > bandEdges[b] && freq <= bandEdges[b+1] {
+				f.Bands[b] += power
+			}
+		}
+	}
+
+	return f
+}
+
+// fft is an in place radix 2 Cooley-Tukey FFT, len(a) must be a power of 2.
+func fft(a []complex128) {
+	var n = len(a)
+
+	// bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		var bit = n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		var w = cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			var wk = complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				var u = a[start+k]
+				var v = a[start+k+size/2] * wk
+				a[start+k] = u + v
+				a[start+k+size/2] = u - v
+				wk *= w
+			}
+		}
+	}
+}
+
+// samples returns the features as derived samples.
+func (f vibrationFeatures) samples(bandEdges []float64) []sample {
+	var samples = []sample{
+		{Quantity: "vibration_rms", Unit: "g", Value: f.RMS},
+		{Quantity: "vibration_peak", Unit: "g", Value: f.Peak},
+		{Quantity: "vibration_crest", Unit: "", Value: f.Crest},
+		{Quantity: "vibration_kurtosis", Unit: "", Value: f.Kurtosis},
+	}
+	for i, e := range f.Bands {
+		samples = append(samples, sample{
+			Quantity: fmt.Sprintf("vibration_band_%g_%ghz", bandEdges[i], bandEdges[i+1]),
+			Unit:     "g²",
+			Value:    e,
+		})
+	}
+	return samples
+}
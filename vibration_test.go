@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+func TestFFT(t *testing.T) {
+	var a = []complex128{1, 2, 3, 4, 0, -1, -2, 5}
+	var want = make([]complex128, len(a))
+	for k := range want {
+		for n, x := range a {
+			want[k] += x * cmplx.Exp(complex(0, -2*math.Pi*float64(k*n)/float64(len(a))))
+		}
+	}
+
+	fft(a)
+	for k := range a {
+		if cmplx.Abs(a[k]-want[k]) > 1e-9 {
+			t.Errorf("bin %d: got %v, want %v", k, a[k], want[k])
+		}
+	}
+}
+
+func TestVibrationFeaturesOfSine(t *testing.T) {
+	// 0.5 g at 2 Hz on top of gravity, sampled with 16 Hz
+	var samples = make([]float64, 64)
+	for i := range samples {
+		samples[i] = 1 + 0.5*math.Sin(2*math.Pi*2*float64(i)/16)
+	}
+
+	var f = vibrationFeaturesOf(samples, 16, []float64{0, 1, 3, 8})
+
+	if math.Abs(f.RMS-0.5/math.Sqrt2) > 1e-3 {
+		t.Errorf("RMS %v", f.RMS)
+	}
+	if math.Abs(f.Peak-0.5) > 1e-3 {
+		t.Errorf("peak %v", f.Peak)
+	}
+	if math.Abs(f.Crest-math.Sqrt2) > 1e-2 {
+		t.Errorf("crest factor %v", f.Crest)
+	}
+	if math.Abs(f.Kurtosis-1.5) > 1e-2 {
+		t.Errorf("kurtosis %v", f.Kurtosis)
+	}
+	if f.Bands[1] < 10*(f.Bands[0]+f.Bands[2]) {
+		t.Errorf("energy not in the 1-3 Hz band: %v", f.Bands)
+	}
+}
+
+func TestVibrationAnalyzerWindows(t *testing.T) {
+	var va = newVibrationAnalyzer(10, 4, 10, nil)
+	if va.window != 8 {
+		t.Fatalf("window %d, want 8", va.window)
+	}
+
+	var windows int
+	for i := 0; i < 16; i++ {
+		if _, ok := va.Add(0, 0, 1+float64(i%2)); ok {
+			windows++
+		}
+	}
+
+	// full after 8 samples, then every 4
+	if windows != 3 {
+		t.Errorf("got %d windows, want 3", windows)
+	}
+}